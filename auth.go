@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	authModeNone  = "none"
+	authModeBasic = "basic"
+	authModeJWT   = "jwt"
+
+	authenticatedContextKey contextKey = "authenticated"
+)
+
+var errUnauthenticated = errors.New("Missing credentials")
+
+// authenticator decides who a request comes from
+// an error means the request is turned away with a 401
+type authenticator interface {
+	authenticate(r *http.Request) (string, error)
+	// challenge goes into the WWW-Authenticate header of a 401
+	challenge() string
+}
+
+// authConfig carries what the authenticators need
+type authConfig struct {
+	mode string
+	// user:password pairs separated by commas
+	basicUsers string
+	// keys tokens are signed with and what the tokens need to say
+	// an empty issuer or audience isn't checked
+	jwksURL  string
+	issuer   string
+	audience string
+}
+
+// newAuthenticator returns nil if requests aren't authenticated
+func newAuthenticator(cfg authConfig) (authenticator, error) {
+	switch cfg.mode {
+	case "", authModeNone:
+		return nil, nil
+	case authModeBasic:
+		return newBasicAuthenticator(cfg.basicUsers)
+	case authModeJWT:
+		return newJWTAuthenticator(cfg.jwksURL, cfg.issuer, cfg.audience)
+	default:
+		return nil, fmt.Errorf("Unknown auth mode [%s]", cfg.mode)
+	}
+}
+
+// basicAuthenticator checks basic auth credentials against a fixed set of users
+// that's what terraforms username and password end up as
+type basicAuthenticator struct {
+	passwords map[string]string
+}
+
+func newBasicAuthenticator(users string) (*basicAuthenticator, error) {
+	passwords := make(map[string]string)
+	for _, pair := range strings.Split(users, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		idx := strings.Index(pair, ":")
+		if idx < 1 || idx == len(pair)-1 {
+			return nil, fmt.Errorf("Basic auth users need to be user:password but one isn't")
+		}
+
+		passwords[pair[:idx]] = pair[idx+1:]
+	}
+
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("Basic auth needs at least one user")
+	}
+
+	return &basicAuthenticator{passwords: passwords}, nil
+}
+
+func (ba *basicAuthenticator) authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", errUnauthenticated
+	}
+
+	expected, ok := ba.passwords[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", fmt.Errorf("Wrong user or password for [%s]", user)
+	}
+
+	return user, nil
+}
+
+func (ba *basicAuthenticator) challenge() string {
+	return `Basic realm="tf-locker"`
+}
+
+// jwtAuthenticator verifies tokens of an OIDC identity provider
+// the subject of the token is the identity of the client
+// terraform can't send bearer tokens, it can send the token as its basic auth password
+type jwtAuthenticator struct {
+	verifier *oidc.IDTokenVerifier
+}
+
+func newJWTAuthenticator(jwksURL string, issuer string, audience string) (*jwtAuthenticator, error) {
+	if jwksURL == "" {
+		return nil, fmt.Errorf("JWT auth needs a JWKS url")
+	}
+
+	// the keys are fetched when they're needed and refetched when they rotate
+	keySet := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	verifier := oidc.NewVerifier(issuer, keySet, &oidc.Config{
+		ClientID:          audience,
+		SkipClientIDCheck: audience == "",
+		SkipIssuerCheck:   issuer == "",
+	})
+	return &jwtAuthenticator{verifier: verifier}, nil
+}
+
+func (ja *jwtAuthenticator) authenticate(r *http.Request) (string, error) {
+	var raw string
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		raw = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	} else if _, password, ok := r.BasicAuth(); ok {
+		raw = password
+	}
+
+	if raw == "" {
+		return "", errUnauthenticated
+	}
+
+	token, err := ja.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return "", err
+	} else if token.Subject == "" {
+		return "", fmt.Errorf("Token has no subject")
+	}
+
+	return token.Subject, nil
+}
+
+func (ja *jwtAuthenticator) challenge() string {
+	return `Bearer realm="tf-locker"`
+}
+
+// authenticate turns away requests the authenticator doesn't accept
+// the identity it found is what requestLogger records
+// requests for public paths and reads with a valid signed url go through as they are
+func (s *httpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil || s.publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.signedURLGrants(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := s.auth.authenticate(r)
+		if err != nil {
+			logrus.Warnf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, clientIP(r, s.trustProxyHeaders), err.Error())
+			w.Header().Set("WWW-Authenticate", s.auth.challenge())
+			writeError(w, http.StatusUnauthorized, "Authentication failed")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authenticatedContextKey, identity)))
+	})
+}
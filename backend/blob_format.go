@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// Blob formats decide how new versions of states are stored.
+// Every binary reads all formats it knows, whatever it writes,
+// so tables can hold versions of different formats.
+const (
+	// the state as terraform sent it, that's how states were always stored
+	BlobFormatPlain = "plain"
+	// gzipped and base64 encoded, the blob column is TEXT
+	BlobFormatGzip = "gzip"
+)
+
+// the first byte of stored blobs that aren't plain
+// plain blobs have no header so that binaries that don't know about formats can still read them
+// terraform states are json and never start with a control character
+// bytes up to maxBlobHeader are reserved for formats
+const (
+	blobHeaderGzip byte = 0x01
+	maxBlobHeader  byte = 0x08
+)
+
+func validBlobFormat(format string) bool {
+	return format == BlobFormatPlain || format == BlobFormatGzip
+}
+
+// encodeBlob turns a state into what is stored in the given format
+// empty blobs stay empty, queries look for them to find states without data
+func encodeBlob(format string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	switch format {
+	case "", BlobFormatPlain:
+		return data, nil
+	case BlobFormatGzip:
+		return gzipBlob(data)
+	default:
+		return nil, fmt.Errorf("Unknown blob format [%s]", format)
+	}
+}
+
+// decodeBlob turns a stored blob of any format back into the state terraform sent
+// md5s are always over what decodeBlob returns
+func decodeBlob(blob []byte) ([]byte, error) {
+	if len(blob) == 0 || blob[0] > maxBlobHeader {
+		return blob, nil
+	}
+
+	switch blob[0] {
+	case blobHeaderGzip:
+		return gunzipBlob(blob[1:])
+	default:
+		// written by a newer binary, handing it out as it is would hand out garbage
+		return nil, fmt.Errorf("Unknown blob format header %#x", blob[0])
+	}
+}
+
+// gzipBlob is data stored in BlobFormatGzip, header included
+func gzipBlob(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	packed := base64.StdEncoding.EncodeToString(buf.Bytes())
+	return append([]byte{blobHeaderGzip}, packed...), nil
+}
+
+// gunzipBlob undoes gzipBlob for a blob without its header
+func gunzipBlob(blob []byte) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(string(blob))
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
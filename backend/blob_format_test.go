@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBlobFormatRoundTrip(t *testing.T) {
+	state := []byte(`{"version":4,"serial":7,"lineage":"2b6e1d2a-5a3c-4f7e-8e5b-0c1d2e3f4a5b"}`)
+	for _, format := range []string{BlobFormatPlain, BlobFormatGzip} {
+		stored, err := encodeBlob(format, state)
+		if err != nil {
+			t.Fatalf("Can't encode %s blob: %s", format, err.Error())
+		}
+
+		// plain blobs need to stay readable for binaries that don't know about formats
+		if format == BlobFormatPlain && !bytes.Equal(stored, state) {
+			t.Fatalf("Plain blob is %q, want the state as it is", stored)
+		} else if format == BlobFormatGzip && stored[0] != blobHeaderGzip {
+			t.Fatalf("Gzip blob starts with %#x, want %#x", stored[0], blobHeaderGzip)
+		}
+
+		data, err := decodeBlob(stored)
+		if err != nil {
+			t.Fatalf("Can't decode %s blob: %s", format, err.Error())
+		} else if !bytes.Equal(data, state) {
+			t.Fatalf("%s blob decodes to %q, want %q", format, data, state)
+		}
+
+		empty, err := encodeBlob(format, nil)
+		if err != nil || len(empty) != 0 {
+			t.Fatalf("Empty %s blob is %q, %v", format, empty, err)
+		}
+	}
+
+	_, err := decodeBlob([]byte{maxBlobHeader, '{', '}'})
+	if err == nil {
+		t.Fatalf("Blob with an unknown header was decoded")
+	}
+}
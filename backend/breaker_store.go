@@ -0,0 +1,341 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	breakerStateGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tf_locker_circuit_breaker_state",
+		Help: "State of the circuit breaker in front of the backend (0 closed, 1 half-open, 2 open)",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge)
+}
+
+// breakerStore wraps another store with a circuit breaker
+// after a number of consecutive backend failures requests fail fast
+// until the cooldown passed and a probe request went through
+type breakerStore struct {
+	store Store
+	cb    *gobreaker.CircuitBreaker
+}
+
+func NewBreakerStore(store Store, consecutiveFailures uint32, cooldown time.Duration) *breakerStore {
+	settings := gobreaker.Settings{
+		Name:        "backend",
+		MaxRequests: 1,
+		Timeout:     cooldown,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= consecutiveFailures
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			logrus.Warnf("Circuit breaker [%s] changed from %s to %s", name, from.String(), to.String())
+			breakerStateGauge.Set(float64(to))
+		},
+	}
+
+	return &breakerStore{
+		store: store,
+		cb:    gobreaker.NewCircuitBreaker(settings),
+	}
+}
+
+// execute runs f through the circuit breaker
+// errors that are part of the protocol (like a lock being taken)
+// are passed through without counting against the breaker
+func (bs *breakerStore) execute(f func() error) error {
+	var opErr error
+	_, err := bs.cb.Execute(func() (interface{}, error) {
+		opErr = f()
+		if isBackendFailure(opErr) {
+			return nil, opErr
+		}
+
+		return nil, nil
+	})
+
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return ErrCircuitOpen
+	}
+
+	return opErr
+}
+
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, protocolErr := range []error{ErrAlreadyLocked, ErrNotLocked, ErrNotFound, ErrNotDeleted, ErrAlreadyExists, ErrLockMismatch, ErrVersionConflict, ErrPreconditionFailed, ErrReadOnly} {
+		if errors.Is(err, protocolErr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bs *breakerStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	var result WriteResult
+	err := bs.execute(func() error {
+		var err error
+		result, err = bs.store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+		return err
+	})
+	return result, err
+}
+
+func (bs *breakerStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	var result WriteResult
+	err := bs.execute(func() error {
+		var err error
+		result, err = bs.store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+		return err
+	})
+	return result, err
+}
+
+func (bs *breakerStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	var result WriteResult
+	err := bs.execute(func() error {
+		var err error
+		result, err = bs.store.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+		return err
+	})
+	return result, err
+}
+
+func (bs *breakerStore) GetState(stateID string, name string) ([]byte, error) {
+	var data []byte
+	err := bs.execute(func() error {
+		var err error
+		data, err = bs.store.GetState(stateID, name)
+		return err
+	})
+	return data, err
+}
+
+func (bs *breakerStore) GetStates(refs []StateRef) ([]*VersionedState, error) {
+	var states []*VersionedState
+	err := bs.execute(func() error {
+		var err error
+		states, err = bs.store.GetStates(refs)
+		return err
+	})
+	return states, err
+}
+
+func (bs *breakerStore) GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error) {
+	var data []byte
+	var li *LockInfo
+	err := bs.execute(func() error {
+		var err error
+		data, li, err = bs.store.GetStateAndLock(stateID, name)
+		return err
+	})
+	return data, li, err
+}
+
+func (bs *breakerStore) GetLockInfo(stateID string, name string) (*LockInfo, error) {
+	var li *LockInfo
+	err := bs.execute(func() error {
+		var err error
+		li, err = bs.store.GetLockInfo(stateID, name)
+		return err
+	})
+	return li, err
+}
+
+func (bs *breakerStore) VerifyLock(stateID string, name string, lockID string) error {
+	return bs.execute(func() error {
+		return bs.store.VerifyLock(stateID, name, lockID)
+	})
+}
+
+func (bs *breakerStore) StateExists(stateID string, name string) (bool, error) {
+	var exists bool
+	err := bs.execute(func() error {
+		var err error
+		exists, err = bs.store.StateExists(stateID, name)
+		return err
+	})
+	return exists, err
+}
+
+func (bs *breakerStore) StateSize(stateID string, name string) (int, error) {
+	var size int
+	err := bs.execute(func() error {
+		var err error
+		size, err = bs.store.StateSize(stateID, name)
+		return err
+	})
+	return size, err
+}
+
+func (bs *breakerStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	var lockID string
+	err := bs.execute(func() error {
+		var err error
+		lockID, err = bs.store.LockState(stateID, name, lockInfo, owner)
+		return err
+	})
+	return lockID, err
+}
+
+func (bs *breakerStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	var data []byte
+	err := bs.execute(func() error {
+		var err error
+		data, err = bs.store.LockAndGet(stateID, name, lockInfo, owner)
+		return err
+	})
+	return data, err
+}
+
+func (bs *breakerStore) UnlockState(stateID string, name string, lockID string) error {
+	return bs.execute(func() error {
+		return bs.store.UnlockState(stateID, name, lockID)
+	})
+}
+
+func (bs *breakerStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	var li *LockInfo
+	err := bs.execute(func() error {
+		var err error
+		li, err = bs.store.ForceUnlock(stateID, name, expectedLockID, override)
+		return err
+	})
+	return li, err
+}
+
+func (bs *breakerStore) ListLocks() ([]*StateLock, error) {
+	var locks []*StateLock
+	err := bs.execute(func() error {
+		var err error
+		locks, err = bs.store.ListLocks()
+		return err
+	})
+	return locks, err
+}
+
+func (bs *breakerStore) ListOrphanedLocks() ([]*StateLock, error) {
+	var locks []*StateLock
+	err := bs.execute(func() error {
+		var err error
+		locks, err = bs.store.ListOrphanedLocks()
+		return err
+	})
+	return locks, err
+}
+
+func (bs *breakerStore) ListWorkspaces(name string) ([]string, error) {
+	var workspaces []string
+	err := bs.execute(func() error {
+		var err error
+		workspaces, err = bs.store.ListWorkspaces(name)
+		return err
+	})
+	return workspaces, err
+}
+
+func (bs *breakerStore) ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error) {
+	var versions []*StateVersion
+	var more bool
+	err := bs.execute(func() error {
+		var err error
+		versions, more, err = bs.store.ListVersions(stateID, name, limit)
+		return err
+	})
+	return versions, more, err
+}
+
+func (bs *breakerStore) ListNames(prefix string) ([]string, error) {
+	var names []string
+	err := bs.execute(func() error {
+		var err error
+		names, err = bs.store.ListNames(prefix)
+		return err
+	})
+	return names, err
+}
+
+func (bs *breakerStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	return bs.execute(func() error {
+		return bs.store.DeleteState(stateID, name, lockID, force, expectedVersion)
+	})
+}
+
+func (bs *breakerStore) UndeleteState(stateID string, name string) (int, error) {
+	var version int
+	err := bs.execute(func() error {
+		var err error
+		version, err = bs.store.UndeleteState(stateID, name)
+		return err
+	})
+	return version, err
+}
+
+func (bs *breakerStore) PurgeState(stateID string, name string, force bool) error {
+	return bs.execute(func() error {
+		return bs.store.PurgeState(stateID, name, force)
+	})
+}
+
+func (bs *breakerStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	return bs.execute(func() error {
+		return bs.store.CopyState(srcID, srcName, dstID, dstName)
+	})
+}
+
+func (bs *breakerStore) WaitForUnlock(stateID string, name string, maxWait time.Duration) error {
+	return bs.store.WaitForUnlock(stateID, name, maxWait)
+}
+
+func (bs *breakerStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	var results []*CompactionResult
+	err := bs.execute(func() error {
+		var err error
+		results, err = bs.store.Compact(retention, vacuum)
+		return err
+	})
+	return results, err
+}
+
+// CheckHealth bypasses the breaker
+// health checks should report what the backend looks like right now
+func (bs *breakerStore) CheckHealth() error {
+	return bs.store.CheckHealth()
+}
+
+// Ping bypasses the breaker just like CheckHealth
+func (bs *breakerStore) Ping() error {
+	return bs.store.Ping()
+}
+
+func (bs *breakerStore) Close() {
+	bs.store.Close()
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type cachedState struct {
+	key    stateKey
+	blob   []byte
+	cached time.Time
+}
+
+// cachingStore keeps the latest blobs of the most recently read states in memory
+// writes and deletes going through this store invalidate their state right away
+// writes that go through other tf-locker instances can't be seen though,
+// an entry is served for at most ttl after it was read from the wrapped store
+// and that is how stale a read can be when several instances share a database
+// with serveStale, reads the wrapped store fails to do are answered with the last blob
+// that was read no matter how old it is together with ErrStaleState
+// answers about the state itself, like ErrNotFound, are passed on as they are
+type cachingStore struct {
+	Store
+
+	mutex      sync.Mutex
+	size       int
+	ttl        time.Duration
+	serveStale bool
+	lru        *list.List
+	entries    map[stateKey]*list.Element
+	generation uint64
+}
+
+func NewCachingStore(store Store, size int, ttl time.Duration, serveStale bool) *cachingStore {
+	return &cachingStore{
+		Store:      store,
+		size:       size,
+		ttl:        ttl,
+		serveStale: serveStale,
+		lru:        list.New(),
+		entries:    make(map[stateKey]*list.Element),
+	}
+}
+
+func (cs *cachingStore) GetState(stateID string, name string) ([]byte, error) {
+	key := stateKey{stateID, name}
+	blob, generation, ok := cs.get(key)
+	if ok {
+		return blob, nil
+	}
+
+	blob, err := cs.Store.GetState(stateID, name)
+	if err != nil && !backendFailure(err) {
+		// the state is gone or changed, the copy in here is wrong
+		cs.invalidate(key)
+		return nil, err
+	} else if err != nil {
+		stale, ok := cs.getStale(key)
+		if cs.serveStale && ok {
+			return stale, fmt.Errorf("%w: %s", ErrStaleState, err.Error())
+		}
+
+		return nil, err
+	}
+
+	cs.put(key, blob, generation)
+	return blob, nil
+}
+
+func (cs *cachingStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	// failed writes might have gone through anyways
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (cs *cachingStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+}
+
+func (cs *cachingStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (cs *cachingStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.DeleteState(stateID, name, lockID, force, expectedVersion)
+}
+
+func (cs *cachingStore) UndeleteState(stateID string, name string) (int, error) {
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.UndeleteState(stateID, name)
+}
+
+func (cs *cachingStore) PurgeState(stateID string, name string, force bool) error {
+	defer cs.invalidate(stateKey{stateID, name})
+	return cs.Store.PurgeState(stateID, name, force)
+}
+
+func (cs *cachingStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	defer cs.invalidate(stateKey{dstID, dstName})
+	return cs.Store.CopyState(srcID, srcName, dstID, dstName)
+}
+
+// backendFailure tells whether the wrapped store failed to read a state
+// rather than answering with one of the errors about the state
+func backendFailure(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+
+	for _, answer := range []error{ErrNotFound, ErrAlreadyLocked, ErrNotLocked, ErrLockMismatch, ErrNotDeleted, ErrPreconditionFailed, ErrLockRequired, ErrStaleState} {
+		if errors.Is(err, answer) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// get returns the cached blob of a state
+// on a miss it returns the generation the caller needs to hand to put
+func (cs *cachingStore) get(key stateKey) ([]byte, uint64, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	elem, ok := cs.entries[key]
+	if !ok {
+		return nil, cs.generation, false
+	}
+
+	entry := elem.Value.(*cachedState)
+	if time.Since(entry.cached) > cs.ttl {
+		// expired entries are only used when serving stale states
+		if !cs.serveStale {
+			cs.lru.Remove(elem)
+			delete(cs.entries, key)
+		}
+		return nil, cs.generation, false
+	}
+
+	cs.lru.MoveToFront(elem)
+	return append(make([]byte, 0, len(entry.blob)), entry.blob...), 0, true
+}
+
+// getStale returns the cached blob of a state even if it expired
+func (cs *cachingStore) getStale(key stateKey) ([]byte, bool) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	elem, ok := cs.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cachedState)
+	return append(make([]byte, 0, len(entry.blob)), entry.blob...), true
+}
+
+// put caches a blob unless something was invalidated since it was read
+// otherwise a read racing a write could put the old blob back
+func (cs *cachingStore) put(key stateKey, blob []byte, generation uint64) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if generation != cs.generation {
+		return
+	}
+
+	entry := &cachedState{
+		key:    key,
+		blob:   append(make([]byte, 0, len(blob)), blob...),
+		cached: time.Now(),
+	}
+
+	elem, ok := cs.entries[key]
+	if ok {
+		elem.Value = entry
+		cs.lru.MoveToFront(elem)
+		return
+	}
+
+	cs.entries[key] = cs.lru.PushFront(entry)
+	for cs.lru.Len() > cs.size {
+		oldest := cs.lru.Back()
+		cs.lru.Remove(oldest)
+		delete(cs.entries, oldest.Value.(*cachedState).key)
+	}
+}
+
+func (cs *cachingStore) invalidate(key stateKey) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.generation++
+	elem, ok := cs.entries[key]
+	if ok {
+		cs.lru.Remove(elem)
+		delete(cs.entries, key)
+	}
+}
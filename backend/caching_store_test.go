@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// failingReadStore fails reads with err once it's set
+type failingReadStore struct {
+	Store
+	err error
+}
+
+func (frs *failingReadStore) GetState(stateID string, name string) ([]byte, error) {
+	if frs.err != nil {
+		return nil, frs.err
+	}
+
+	return frs.Store.GetState(stateID, name)
+}
+
+func TestCachingStoreServesStaleOnlyForFailures(t *testing.T) {
+	wrapped := &failingReadStore{Store: NewMemoryStore()}
+	// every entry has expired by the time it's read again
+	cs := NewCachingStore(wrapped, 10, 0, true)
+
+	stateID := uuid.New().String()
+	_, err := wrapped.UpsertState(stateID, "stale", "", []byte("state"), "")
+	if err != nil {
+		t.Fatalf("Write failed: %s", err.Error())
+	}
+
+	_, err = cs.GetState(stateID, "stale")
+	if err != nil {
+		t.Fatalf("Read failed: %s", err.Error())
+	}
+
+	for _, failure := range []error{errors.New("connection refused"), ErrCircuitOpen} {
+		wrapped.err = failure
+		data, err := cs.GetState(stateID, "stale")
+		if !errors.Is(err, ErrStaleState) || string(data) != "state" {
+			t.Fatalf("Read failing with %v answered %q, %v, want the stale state", failure, data, err)
+		}
+	}
+
+	// a state deleted through another instance is gone, not stale
+	wrapped.err = fmt.Errorf("Can't read [stale] [%s]: %w", stateID, ErrNotFound)
+	data, err := cs.GetState(stateID, "stale")
+	if !errors.Is(err, ErrNotFound) || data != nil {
+		t.Fatalf("Read of a deleted state answered %q, %v, want %v", data, err, ErrNotFound)
+	}
+
+	// and doesn't come back when the backend fails afterwards
+	wrapped.err = errors.New("connection refused")
+	data, err = cs.GetState(stateID, "stale")
+	if errors.Is(err, ErrStaleState) || data != nil {
+		t.Fatalf("Read after the delete answered %q, %v, want the failure", data, err)
+	}
+}
@@ -0,0 +1,286 @@
+//go:build chaos
+// +build chaos
+
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errChaos = errors.New("Injected failure")
+
+// chaosStore makes a fraction of all operations fail for testing clients against a flaky locker
+// half of the unlucky operations fail right away, the other half is delayed
+// by more than the clients timeout before it goes through
+// it only exists in binaries built with the chaos tag
+type chaosStore struct {
+	Store
+	failureRate float64
+	delay       time.Duration
+}
+
+// NewChaosStore wraps a store so that failureRate of its operations fail or hang
+func NewChaosStore(store Store, failureRate float64, delay time.Duration) (Store, error) {
+	if failureRate < 0 || failureRate > 1 {
+		return nil, fmt.Errorf("Chaos failure rate needs to be between 0 and 1 but is %f", failureRate)
+	}
+
+	logrus.Warnf("CHAOS MODE: %.0f%% of all backend operations fail or are delayed by %s", failureRate*100, delay)
+	return &chaosStore{
+		Store:       store,
+		failureRate: failureRate,
+		delay:       delay,
+	}, nil
+}
+
+// inject decides the fate of an operation
+// it returns an error for operations that fail
+// and blocks operations that are delayed
+func (cs *chaosStore) inject() error {
+	dice := rand.Float64()
+	if dice >= cs.failureRate {
+		return nil
+	} else if dice < cs.failureRate/2 {
+		return errChaos
+	}
+
+	time.Sleep(cs.delay)
+	return nil
+}
+
+func (cs *chaosStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	if err := cs.inject(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return cs.Store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (cs *chaosStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	if err := cs.inject(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return cs.Store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+}
+
+func (cs *chaosStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	if err := cs.inject(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return cs.Store.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (cs *chaosStore) GetState(stateID string, name string) ([]byte, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.GetState(stateID, name)
+}
+
+func (cs *chaosStore) GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error) {
+	if err := cs.inject(); err != nil {
+		return nil, nil, err
+	}
+
+	return cs.Store.GetStateAndLock(stateID, name)
+}
+
+func (cs *chaosStore) GetLockInfo(stateID string, name string) (*LockInfo, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.GetLockInfo(stateID, name)
+}
+
+func (cs *chaosStore) VerifyLock(stateID string, name string, lockID string) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.VerifyLock(stateID, name, lockID)
+}
+
+func (cs *chaosStore) StateExists(stateID string, name string) (bool, error) {
+	if err := cs.inject(); err != nil {
+		return false, err
+	}
+
+	return cs.Store.StateExists(stateID, name)
+}
+
+func (cs *chaosStore) StateSize(stateID string, name string) (int, error) {
+	if err := cs.inject(); err != nil {
+		return 0, err
+	}
+
+	return cs.Store.StateSize(stateID, name)
+}
+
+func (cs *chaosStore) GetStates(refs []StateRef) ([]*VersionedState, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.GetStates(refs)
+}
+
+func (cs *chaosStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	if err := cs.inject(); err != nil {
+		return "", err
+	}
+
+	return cs.Store.LockState(stateID, name, lockInfo, owner)
+}
+
+func (cs *chaosStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.LockAndGet(stateID, name, lockInfo, owner)
+}
+
+func (cs *chaosStore) UnlockState(stateID string, name string, lockID string) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.UnlockState(stateID, name, lockID)
+}
+
+func (cs *chaosStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.ForceUnlock(stateID, name, expectedLockID, override)
+}
+
+func (cs *chaosStore) ListLocks() ([]*StateLock, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.ListLocks()
+}
+
+func (cs *chaosStore) ListOrphanedLocks() ([]*StateLock, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.ListOrphanedLocks()
+}
+
+func (cs *chaosStore) ListWorkspaces(name string) ([]string, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.ListWorkspaces(name)
+}
+
+func (cs *chaosStore) ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error) {
+	if err := cs.inject(); err != nil {
+		return nil, false, err
+	}
+
+	return cs.Store.ListVersions(stateID, name, limit)
+}
+
+func (cs *chaosStore) ListNames(prefix string) ([]string, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.ListNames(prefix)
+}
+
+func (cs *chaosStore) WaitForUnlock(stateID string, name string, maxWait time.Duration) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.WaitForUnlock(stateID, name, maxWait)
+}
+
+func (cs *chaosStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.DeleteState(stateID, name, lockID, force, expectedVersion)
+}
+
+func (cs *chaosStore) UndeleteState(stateID string, name string) (int, error) {
+	if err := cs.inject(); err != nil {
+		return 0, err
+	}
+
+	return cs.Store.UndeleteState(stateID, name)
+}
+
+func (cs *chaosStore) PurgeState(stateID string, name string, force bool) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.PurgeState(stateID, name, force)
+}
+
+func (cs *chaosStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.CopyState(srcID, srcName, dstID, dstName)
+}
+
+func (cs *chaosStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	if err := cs.inject(); err != nil {
+		return nil, err
+	}
+
+	return cs.Store.Compact(retention, vacuum)
+}
+
+func (cs *chaosStore) CheckHealth() error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.CheckHealth()
+}
+
+func (cs *chaosStore) Ping() error {
+	if err := cs.inject(); err != nil {
+		return err
+	}
+
+	return cs.Store.Ping()
+}
@@ -0,0 +1,32 @@
+//go:build !chaos
+// +build !chaos
+
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"time"
+)
+
+// NewChaosStore refuses to inject failures
+// production binaries are built without the chaos tag
+// and a stray CHAOS_FAILURE_RATE can't do any harm there
+func NewChaosStore(store Store, failureRate float64, delay time.Duration) (Store, error) {
+	return store, errors.New("This binary was built without chaos support, rebuild it with -tags chaos")
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	cases := []struct {
+		dsn      string
+		redacted string
+	}{
+		{"host=db password=secret dbname=tf", "host=db password=xxxxx dbname=tf"},
+		{"host=db password = secret dbname=tf", "host=db password=xxxxx dbname=tf"},
+		{"host=db password= secret", "host=db password=xxxxx"},
+		{"host=db password='sec ret' dbname=tf", "host=db password=xxxxx dbname=tf"},
+		{`host=db password='it\'s secret'`, "host=db password=xxxxx"},
+		{"host=db dbname=tf", "host=db dbname=tf"},
+		{"postgres://tf:secret@db/tf", "postgres://tf:xxxxx@db/tf"},
+	}
+
+	for _, c := range cases {
+		redacted := RedactDSN(c.dsn)
+		if redacted != c.redacted {
+			t.Errorf("RedactDSN(%q) = %q, want %q", c.dsn, redacted, c.redacted)
+		}
+
+		if strings.Contains(redacted, "secret") {
+			t.Errorf("RedactDSN(%q) leaks the password: %q", c.dsn, redacted)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// dualWriteStore mirrors all changes to a secondary store
+// it's meant for moving tf-locker to a new database without downtime
+// the primary is the source of truth: reads only go there
+// and a change is only mirrored after it succeeded on the primary
+// failures on the secondary are logged but never fail the request
+type dualWriteStore struct {
+	Store
+	secondary Store
+}
+
+func NewDualWriteStore(primary Store, secondary Store) *dualWriteStore {
+	return &dualWriteStore{
+		Store:     primary,
+		secondary: secondary,
+	}
+}
+
+func (dws *dualWriteStore) mirror(operation string, stateID string, name string, err error) {
+	if err != nil {
+		logrus.Warnf("Can't mirror %s of [%s] [%s] to the secondary store: %s", operation, name, stateID, err.Error())
+	}
+}
+
+func (dws *dualWriteStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	result, err := dws.Store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = dws.secondary.UpsertState(stateID, name, lockID, data, idempotencyKey)
+	dws.mirror("write", stateID, name, err)
+	return result, nil
+}
+
+func (dws *dualWriteStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	result, err := dws.Store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+	if err != nil {
+		return result, err
+	}
+
+	// the primary checked the md5 already
+	_, err = dws.secondary.UpsertState(stateID, name, lockID, data, idempotencyKey)
+	dws.mirror("write", stateID, name, err)
+	return result, nil
+}
+
+func (dws *dualWriteStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	result, err := dws.Store.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+	if err != nil {
+		return result, err
+	}
+
+	_, err = dws.secondary.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+	dws.mirror("commit", stateID, name, err)
+	return result, nil
+}
+
+func (dws *dualWriteStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	lockID, err := dws.Store.LockState(stateID, name, lockInfo, owner)
+	if err != nil {
+		return lockID, err
+	}
+
+	_, err = dws.secondary.LockState(stateID, name, lockInfo, owner)
+	dws.mirror("lock", stateID, name, err)
+	return lockID, nil
+}
+
+func (dws *dualWriteStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	data, err := dws.Store.LockAndGet(stateID, name, lockInfo, owner)
+	if err != nil {
+		return data, err
+	}
+
+	_, err = dws.secondary.LockState(stateID, name, lockInfo, owner)
+	dws.mirror("lock", stateID, name, err)
+	return data, nil
+}
+
+func (dws *dualWriteStore) UnlockState(stateID string, name string, lockID string) error {
+	err := dws.Store.UnlockState(stateID, name, lockID)
+	if err != nil {
+		return err
+	}
+
+	dws.mirror("unlock", stateID, name, dws.secondary.UnlockState(stateID, name, lockID))
+	return nil
+}
+
+func (dws *dualWriteStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	li, err := dws.Store.ForceUnlock(stateID, name, expectedLockID, override)
+	if err != nil {
+		return li, err
+	}
+
+	_, err = dws.secondary.ForceUnlock(stateID, name, expectedLockID, override)
+	dws.mirror("force unlock", stateID, name, err)
+	return li, nil
+}
+
+func (dws *dualWriteStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	err := dws.Store.DeleteState(stateID, name, lockID, force, expectedVersion)
+	if err != nil {
+		return err
+	}
+
+	// versions don't line up between the stores, the primary checked it already
+	dws.mirror("delete", stateID, name, dws.secondary.DeleteState(stateID, name, lockID, force, 0))
+	return nil
+}
+
+func (dws *dualWriteStore) UndeleteState(stateID string, name string) (int, error) {
+	version, err := dws.Store.UndeleteState(stateID, name)
+	if err != nil {
+		return version, err
+	}
+
+	_, err = dws.secondary.UndeleteState(stateID, name)
+	dws.mirror("undelete", stateID, name, err)
+	return version, nil
+}
+
+func (dws *dualWriteStore) PurgeState(stateID string, name string, force bool) error {
+	err := dws.Store.PurgeState(stateID, name, force)
+	if err != nil {
+		return err
+	}
+
+	dws.mirror("purge", stateID, name, dws.secondary.PurgeState(stateID, name, force))
+	return nil
+}
+
+func (dws *dualWriteStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	err := dws.Store.CopyState(srcID, srcName, dstID, dstName)
+	if err != nil {
+		return err
+	}
+
+	dws.mirror("copy", dstID, dstName, dws.secondary.CopyState(srcID, srcName, dstID, dstName))
+	return nil
+}
+
+func (dws *dualWriteStore) Close() {
+	dws.Store.Close()
+	dws.secondary.Close()
+}
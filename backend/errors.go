@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import "errors"
+
+// the errors the stores hand back for conditions that are part of the protocol
+// stores may wrap them with more context, check for them with errors.Is
+
+// ErrAlreadyLocked means somebody else holds the lock on the state
+var ErrAlreadyLocked = errors.New("Already locked")
+
+// ErrNotLocked means the state isn't locked at all
+var ErrNotLocked = errors.New("Not locked")
+
+// ErrNotFound means the state (or version) doesn't exist
+var ErrNotFound = errors.New("Not found")
+
+// ErrAlreadyExists means the state can't be created because it exists already
+var ErrAlreadyExists = errors.New("Already exists")
+
+// ErrLockMismatch means the caller presented a lock id that doesn't hold the lock
+var ErrLockMismatch = errors.New("Lock held by somebody else")
+
+// ErrVersionConflict means a concurrent writer changed the state first
+var ErrVersionConflict = errors.New("State was changed concurrently")
+
+// ErrNotDeleted means the state can't be restored because it wasn't deleted
+var ErrNotDeleted = errors.New("Not deleted")
+
+// ErrPreconditionFailed means the state didn't match what the caller expected
+var ErrPreconditionFailed = errors.New("Precondition failed")
+
+// ErrReadOnly means the store doesn't accept writes right now
+var ErrReadOnly = errors.New("Store is read-only")
+
+// ErrSchemaNotReady means the database is up but the schema isn't usable
+var ErrSchemaNotReady = errors.New("Schema not initialized")
+
+// ErrCircuitOpen means the backend failed too often and requests fail fast
+var ErrCircuitOpen = errors.New("Backend unavailable")
+
+// ErrStaleState comes with a state that couldn't be read from the backend
+// the state that comes with it is the last one that could be read
+var ErrStaleState = errors.New("Serving stale state")
+
+// ErrLockRequired means the state has to be locked before it can be written
+var ErrLockRequired = errors.New("State has to be locked first")
@@ -0,0 +1,886 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const (
+	// DefaultEtcdPrefix is where the keys of tf-locker live by default
+	DefaultEtcdPrefix = "/tf-locker"
+	// DefaultEtcdLockTTL is how long a lock lives by default
+	DefaultEtcdLockTTL = 24 * time.Hour
+	// a change that keeps losing against concurrent changes gives up after this many attempts
+	etcdTxnAttempts = 10
+)
+
+// EtcdOptions tune the etcd store
+type EtcdOptions struct {
+	Endpoints []string
+	// all keys of tf-locker start with this
+	// empty means DefaultEtcdPrefix
+	Prefix string
+	// how long a lock lives unless its holder takes it again
+	// zero means DefaultEtcdLockTTL
+	LockTTL time.Duration
+	// how long operations wait for etcd
+	Timeout time.Duration
+}
+
+// etcdStore keeps states in etcd
+// every state is one key holding its latest version, there is no history
+// the lock of a state is a key of its own that is attached to a lease
+// a lock the holder neither releases nor takes again within the lock ttl
+// expires together with its lease
+// etcd limits the size of requests (1.5MiB unless --max-request-bytes says otherwise)
+// and with that the size of states
+type etcdStore struct {
+	client  *clientv3.Client
+	prefix  string
+	lockTTL time.Duration
+	timeout time.Duration
+}
+
+// etcdState is the value of a state key
+type etcdState struct {
+	Version int       `json:"version"`
+	Blob    []byte    `json:"blob"`
+	Written time.Time `json:"written"`
+	// the blob before the latest version deleted the state
+	Deleted     bool   `json:"deleted,omitempty"`
+	DeletedBlob []byte `json:"deleted_blob,omitempty"`
+	LastLockID  string `json:"last_lock_id,omitempty"`
+	// only the latest write is remembered, retries come right after the original
+	IdempotencyKey     string `json:"idempotency_key,omitempty"`
+	IdempotencyVersion int    `json:"idempotency_version,omitempty"`
+	IdempotencySerial  int64  `json:"idempotency_serial,omitempty"`
+}
+
+// etcdLock is the value of a lock key
+type etcdLock struct {
+	LockInfo string    `json:"lock_info"`
+	Owner    string    `json:"owner,omitempty"`
+	LockedAt time.Time `json:"locked_at"`
+}
+
+// etcdSnapshot is a state, its lock and its serial as they were at one revision
+type etcdSnapshot struct {
+	stateKey  string
+	lockKey   string
+	serialKey string
+	// nil if there is no such key
+	state *etcdState
+	lock  *etcdLock
+	// zero if there is no such key
+	serial         int64
+	stateRevision  int64
+	lockRevision   int64
+	serialRevision int64
+	lease          clientv3.LeaseID
+}
+
+func (snap *etcdSnapshot) lockInfo() string {
+	if snap.lock == nil {
+		return ""
+	}
+
+	return snap.lock.LockInfo
+}
+
+// latest is a copy of the state that can be changed and written back
+func (snap *etcdSnapshot) latest() *etcdState {
+	if snap.state == nil {
+		return &etcdState{}
+	}
+
+	state := *snap.state
+	return &state
+}
+
+// unchanged holds as long as nobody touched the state, its lock and its serial since the snapshot
+func (snap *etcdSnapshot) unchanged() []clientv3.Cmp {
+	return []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(snap.stateKey), "=", snap.stateRevision),
+		clientv3.Compare(clientv3.ModRevision(snap.lockKey), "=", snap.lockRevision),
+		clientv3.Compare(clientv3.ModRevision(snap.serialKey), "=", snap.serialRevision),
+	}
+}
+
+func NewEtcdStore(opts EtcdOptions) (*etcdStore, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultEtcdPrefix
+	}
+
+	if opts.LockTTL <= 0 {
+		opts.LockTTL = DefaultEtcdLockTTL
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = timeout
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		DialTimeout: opts.Timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	es := &etcdStore{
+		client:  client,
+		prefix:  strings.TrimSuffix(opts.Prefix, "/"),
+		lockTTL: opts.LockTTL,
+		timeout: opts.Timeout,
+	}
+
+	err = es.CheckHealth()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return es, nil
+}
+
+// keys start with the state id, it never contains a slash while names can
+func (es *etcdStore) stateKey(stateID string, name string) string {
+	return es.prefix + "/states/" + stateID + "/" + name
+}
+
+func (es *etcdStore) lockKey(stateID string, name string) string {
+	return es.prefix + "/locks/" + stateID + "/" + name
+}
+
+func (es *etcdStore) serialKey(stateID string, name string) string {
+	return es.prefix + "/serials/" + stateID + "/" + name
+}
+
+// parseKey splits a key below dir into the state it belongs to
+func (es *etcdStore) parseKey(dir string, key []byte) (stateKey, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(string(key), es.prefix+dir), "/", 2)
+	if len(parts) != 2 {
+		return stateKey{}, false
+	}
+
+	return stateKey{parts[0], parts[1]}, true
+}
+
+// read takes a snapshot of a state, its lock and its serial
+func (es *etcdStore) read(ctx context.Context, stateID string, name string) (*etcdSnapshot, error) {
+	snap := &etcdSnapshot{
+		stateKey:  es.stateKey(stateID, name),
+		lockKey:   es.lockKey(stateID, name),
+		serialKey: es.serialKey(stateID, name),
+	}
+
+	resp, err := es.client.Txn(ctx).Then(clientv3.OpGet(snap.stateKey), clientv3.OpGet(snap.lockKey), clientv3.OpGet(snap.serialKey)).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	stateKvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(stateKvs) > 0 {
+		snap.state = &etcdState{}
+		err = json.Unmarshal(stateKvs[0].Value, snap.state)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse state [%s] [%s]: %s", name, stateID, err.Error())
+		}
+
+		snap.stateRevision = stateKvs[0].ModRevision
+	}
+
+	lockKvs := resp.Responses[1].GetResponseRange().Kvs
+	if len(lockKvs) > 0 {
+		snap.lock = &etcdLock{}
+		err = json.Unmarshal(lockKvs[0].Value, snap.lock)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse lock of [%s] [%s]: %s", name, stateID, err.Error())
+		}
+
+		snap.lockRevision = lockKvs[0].ModRevision
+		snap.lease = clientv3.LeaseID(lockKvs[0].Lease)
+	}
+
+	serialKvs := resp.Responses[2].GetResponseRange().Kvs
+	if len(serialKvs) > 0 {
+		snap.serial, err = strconv.ParseInt(string(serialKvs[0].Value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse serial of [%s] [%s]: %s", name, stateID, err.Error())
+		}
+
+		snap.serialRevision = serialKvs[0].ModRevision
+	}
+
+	return snap, nil
+}
+
+// update lets change look at a snapshot of a state and decide what to write
+// it starts over with a new snapshot when a concurrent change got in between
+func (es *etcdStore) update(stateID string, name string, change func(snap *etcdSnapshot) ([]clientv3.Op, error)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	for attempt := 1; attempt <= etcdTxnAttempts; attempt++ {
+		snap, err := es.read(ctx, stateID, name)
+		if err != nil {
+			return err
+		}
+
+		ops, err := change(snap)
+		if err != nil {
+			return err
+		}
+
+		resp, err := es.client.Txn(ctx).If(snap.unchanged()...).Then(ops...).Commit()
+		if err != nil {
+			return err
+		} else if resp.Succeeded {
+			return nil
+		}
+
+		logrus.Infof("[%s] [%s] was changed concurrently, retrying (attempt %d of %d)", name, stateID, attempt, etcdTxnAttempts)
+	}
+
+	return fmt.Errorf("Can't change [%s] [%s]: %w", name, stateID, ErrVersionConflict)
+}
+
+func putJSON(key string, v interface{}, opts ...clientv3.OpOption) (clientv3.Op, error) {
+	bites, err := json.Marshal(v)
+	if err != nil {
+		return clientv3.Op{}, err
+	}
+
+	return clientv3.OpPut(key, string(bites), opts...), nil
+}
+
+// revoke gives up the lease of a lock that isn't needed anymore
+// leases that are left behind expire after the lock ttl
+func (es *etcdStore) revoke(lease clientv3.LeaseID) {
+	if lease == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	_, err := es.client.Revoke(ctx, lease)
+	if err != nil {
+		logrus.Warnf("Can't revoke lease %d: %s", lease, err.Error())
+	}
+}
+
+func (es *etcdStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return es.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, false)
+}
+
+func (es *etcdStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	return es.writeState(stateID, name, lockID, data, false, 0, expectedMD5, idempotencyKey, false, false)
+}
+
+func (es *etcdStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return es.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, true)
+}
+
+// writeState follows the same rules as the one of the postgres store
+func (es *etcdStore) writeState(stateID string, name string, lockID string, data []byte, force bool, expectedVersion int, expectedMD5 string, key string, deleted bool, unlock bool) (WriteResult, error) {
+	var result WriteResult
+	var lease clientv3.LeaseID
+	err := es.update(stateID, name, func(snap *etcdSnapshot) ([]clientv3.Op, error) {
+		state := snap.latest()
+		lease = 0
+		if key != "" && state.IdempotencyKey == key {
+			result = WriteResult{Version: state.IdempotencyVersion, Serial: state.IdempotencySerial}
+			return nil, nil
+		}
+
+		lockInfo := snap.lockInfo()
+		if lockInfo != "" && lockIDFromLockInfo(lockInfo) != lockID && !force {
+			return nil, lockedError(lockInfo)
+		} else if unlock && (lockID == "" || lockInfo == "") {
+			return nil, fmt.Errorf("Can't unlock [%s] [%s] after the write: %w", name, stateID, ErrNotLocked)
+		} else if expectedVersion != 0 && state.Version != expectedVersion {
+			return nil, ErrPreconditionFailed
+		} else if expectedMD5 != "" && (snap.state == nil || blobMD5(state.Blob) != expectedMD5) {
+			return nil, ErrPreconditionFailed
+		}
+
+		created := len(state.Blob) == 0
+		state.Deleted = deleted
+		state.DeletedBlob = nil
+		if deleted {
+			state.DeletedBlob = state.Blob
+		}
+
+		state.Version++
+		state.Blob = data
+		state.Written = time.Now()
+		state.IdempotencyKey = key
+		state.IdempotencyVersion = state.Version
+		// the serial goes into the same transaction as the state
+		state.IdempotencySerial = snap.serial + 1
+
+		ops := make([]clientv3.Op, 0, 3)
+		if lockInfo != "" && (lockID == "" || unlock) {
+			// a forced write without lock id breaks the lock
+			if unlock {
+				state.LastLockID = lockIDFromLockInfo(lockID)
+			}
+			ops = append(ops, clientv3.OpDelete(snap.lockKey))
+			lease = snap.lease
+		}
+
+		put, err := putJSON(snap.stateKey, state)
+		if err != nil {
+			return nil, err
+		}
+
+		result = WriteResult{Version: state.Version, Serial: state.IdempotencySerial, Created: created}
+		return append(ops, put, clientv3.OpPut(snap.serialKey, strconv.FormatInt(result.Serial, 10))), nil
+	})
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	es.revoke(lease)
+	return result, nil
+}
+
+func (es *etcdStore) GetState(stateID string, name string) ([]byte, error) {
+	data, _, err := es.GetStateAndLock(stateID, name)
+	return data, err
+}
+
+func (es *etcdStore) GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	snap, err := es.read(ctx, stateID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return snap.latest().Blob, storedLockInfo(snap.lockInfo()), nil
+}
+
+func (es *etcdStore) GetLockInfo(stateID string, name string) (*LockInfo, error) {
+	_, li, err := es.GetStateAndLock(stateID, name)
+	if err != nil {
+		return nil, err
+	} else if li == nil {
+		return nil, ErrNotLocked
+	}
+
+	return li, nil
+}
+
+func (es *etcdStore) VerifyLock(stateID string, name string, lockID string) error {
+	li, err := es.GetLockInfo(stateID, name)
+	if err != nil {
+		return err
+	}
+
+	return verifyLockHolder(li, lockID)
+}
+
+func (es *etcdStore) StateExists(stateID string, name string) (bool, error) {
+	data, err := es.GetState(stateID, name)
+	if err != nil {
+		return false, err
+	}
+
+	return len(data) > 0, nil
+}
+
+func (es *etcdStore) StateSize(stateID string, name string) (int, error) {
+	data, err := es.GetState(stateID, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (es *etcdStore) GetStates(refs []StateRef) ([]*VersionedState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	states := make([]*VersionedState, 0, len(refs))
+	for _, ref := range refs {
+		snap, err := es.read(ctx, ref.StateID, ref.Name)
+		if err != nil {
+			return nil, err
+		} else if snap.state == nil || len(snap.state.Blob) == 0 {
+			continue
+		}
+
+		states = append(states, &VersionedState{
+			StateID: ref.StateID,
+			Name:    ref.Name,
+			Version: snap.state.Version,
+			Data:    snap.state.Blob,
+		})
+	}
+
+	return states, nil
+}
+
+func (es *etcdStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	_, err := es.lockState(stateID, name, lockInfo, owner)
+	if err != nil {
+		return "", err
+	}
+
+	return lockIDFromLockInfo(lockInfo), nil
+}
+
+func (es *etcdStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	return es.lockState(stateID, name, lockInfo, owner)
+}
+
+// lockState creates the lock key on a new lease unless it exists already
+// a failed compare on the create revision means somebody holds the lock
+// when that's the same lock, it moves to the new lease and is taken again
+func (es *etcdStore) lockState(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	lease, err := es.client.Grant(ctx, int64(es.lockTTL.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	stateKey := es.stateKey(stateID, name)
+	lockKey := es.lockKey(stateID, name)
+	put, err := putJSON(lockKey, &etcdLock{LockInfo: lockInfo, Owner: owner, LockedAt: time.Now()}, clientv3.WithLease(lease.ID))
+	if err != nil {
+		es.revoke(lease.ID)
+		return nil, err
+	}
+
+	for attempt := 1; attempt <= etcdTxnAttempts; attempt++ {
+		resp, err := es.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
+			Then(put, clientv3.OpGet(stateKey)).
+			Else(clientv3.OpGet(lockKey), clientv3.OpGet(stateKey)).
+			Commit()
+		if err != nil {
+			es.revoke(lease.ID)
+			return nil, err
+		}
+
+		state := &etcdState{}
+		stateKvs := resp.Responses[1].GetResponseRange().Kvs
+		if len(stateKvs) > 0 {
+			err = json.Unmarshal(stateKvs[0].Value, state)
+			if err != nil {
+				es.revoke(lease.ID)
+				return nil, fmt.Errorf("Can't parse state [%s] [%s]: %s", name, stateID, err.Error())
+			}
+		}
+
+		if resp.Succeeded {
+			return state.Blob, nil
+		}
+
+		lockKvs := resp.Responses[0].GetResponseRange().Kvs
+		if len(lockKvs) == 0 {
+			// released right after our compare
+			continue
+		}
+
+		held := &etcdLock{}
+		err = json.Unmarshal(lockKvs[0].Value, held)
+		if err != nil {
+			es.revoke(lease.ID)
+			return nil, fmt.Errorf("Can't parse lock of [%s] [%s]: %s", name, stateID, err.Error())
+		} else if held.LockInfo != lockInfo {
+			es.revoke(lease.ID)
+			return nil, lockedError(held.LockInfo)
+		}
+
+		// the holder takes its lock again, that renews the lease and when it was taken
+		refresh, err := es.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(lockKey), "=", lockKvs[0].ModRevision)).
+			Then(put).
+			Commit()
+		if err != nil {
+			es.revoke(lease.ID)
+			return nil, err
+		} else if refresh.Succeeded {
+			es.revoke(clientv3.LeaseID(lockKvs[0].Lease))
+			return state.Blob, nil
+		}
+	}
+
+	es.revoke(lease.ID)
+	return nil, fmt.Errorf("Can't lock [%s] [%s]: %w", name, stateID, ErrVersionConflict)
+}
+
+func (es *etcdStore) UnlockState(stateID string, name string, lockID string) error {
+	requestedLockID := lockIDFromLockInfo(lockID)
+	var lease clientv3.LeaseID
+	err := es.update(stateID, name, func(snap *etcdSnapshot) ([]clientv3.Op, error) {
+		lease = 0
+		lockInfo := snap.lockInfo()
+		if snap.state == nil && snap.lock == nil {
+			return nil, fmt.Errorf("Can't unlock [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if lockInfo == "" && snap.latest().LastLockID == requestedLockID {
+			// this is most likely a retried unlock and we let it succeed
+			return nil, nil
+		} else if lockIDFromLockInfo(lockInfo) != requestedLockID {
+			return nil, fmt.Errorf("Can't unlock [%s] [%s] with lock [%s]: %w", name, stateID, lockID, lockMismatchError(lockInfo))
+		}
+
+		return es.clearLock(snap, requestedLockID, &lease)
+	})
+	if err != nil {
+		return err
+	}
+
+	es.revoke(lease)
+	return nil
+}
+
+// clearLock are the operations that release the lock of a snapshot
+// lockID is remembered so that retries of the unlock succeed
+func (es *etcdStore) clearLock(snap *etcdSnapshot, lockID string, lease *clientv3.LeaseID) ([]clientv3.Op, error) {
+	state := snap.latest()
+	state.LastLockID = lockID
+	put, err := putJSON(snap.stateKey, state)
+	if err != nil {
+		return nil, err
+	}
+
+	*lease = snap.lease
+	return []clientv3.Op{put, clientv3.OpDelete(snap.lockKey)}, nil
+}
+
+func (es *etcdStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	var li *LockInfo
+	var lease clientv3.LeaseID
+	err := es.update(stateID, name, func(snap *etcdSnapshot) ([]clientv3.Op, error) {
+		lease = 0
+		if snap.lock == nil {
+			li = nil
+			return nil, ErrNotLocked
+		}
+
+		li = parseLockInfo(snap.lock.LockInfo)
+		if !override && li.ID != lockIDFromLockInfo(expectedLockID) {
+			return nil, ErrLockMismatch
+		}
+
+		return es.clearLock(snap, li.ID, &lease)
+	})
+	if err != nil {
+		return li, err
+	}
+
+	es.revoke(lease)
+	return li, nil
+}
+
+func (es *etcdStore) ListLocks() ([]*StateLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	resp, err := es.client.Get(ctx, es.prefix+"/locks/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make([]*StateLock, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key, ok := es.parseKey("/locks/", kv.Key)
+		lock := &etcdLock{}
+		if !ok || json.Unmarshal(kv.Value, lock) != nil {
+			logrus.Warnf("Skipping malformed lock [%s]", string(kv.Key))
+			continue
+		}
+
+		locks = append(locks, &StateLock{
+			StateID:  key.stateID,
+			Name:     key.name,
+			LockInfo: parseLockInfo(lock.LockInfo),
+			Owner:    lock.Owner,
+			LockedAt: lock.LockedAt,
+		})
+	}
+
+	return locks, nil
+}
+
+// ListOrphanedLocks returns the locks of states that were never written
+// taking a lock doesn't create the state key, its first write does
+func (es *etcdStore) ListOrphanedLocks() ([]*StateLock, error) {
+	locks, err := es.ListLocks()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	orphaned := make([]*StateLock, 0)
+	for _, lock := range locks {
+		snap, err := es.read(ctx, lock.StateID, lock.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		state := snap.latest()
+		if state.Version <= 1 && len(state.Blob) == 0 {
+			lock.Orphaned = true
+			orphaned = append(orphaned, lock)
+		}
+	}
+
+	return orphaned, nil
+}
+
+// listStateNames returns the names of all states with a blob that match
+func (es *etcdStore) listStateNames(match func(name string) bool) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	resp, err := es.client.Get(ctx, es.prefix+"/states/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	stateNames := make([]string, 0)
+	for _, kv := range resp.Kvs {
+		key, ok := es.parseKey("/states/", kv.Key)
+		state := &etcdState{}
+		if !ok || json.Unmarshal(kv.Value, state) != nil {
+			logrus.Warnf("Skipping malformed state [%s]", string(kv.Key))
+			continue
+		}
+
+		if len(state.Blob) > 0 && match(key.name) {
+			stateNames = append(stateNames, key.name)
+		}
+	}
+
+	return stateNames, nil
+}
+
+func (es *etcdStore) ListWorkspaces(name string) ([]string, error) {
+	stateNames, err := es.listStateNames(func(stateName string) bool {
+		return stateName == name || strings.HasPrefix(stateName, name+WorkspaceSeparator)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return workspacesFromStateNames(name, stateNames), nil
+}
+
+func (es *etcdStore) ListNames(prefix string) ([]string, error) {
+	stateNames, err := es.listStateNames(func(stateName string) bool {
+		return strings.HasPrefix(stateName, prefix)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return uniqueSortedNames(stateNames), nil
+}
+
+// ListVersions only knows the latest version, there is no history in etcd
+func (es *etcdStore) ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	snap, err := es.read(ctx, stateID, name)
+	if err != nil {
+		return nil, false, err
+	} else if snap.state == nil {
+		return nil, false, fmt.Errorf("No versions of [%s] [%s]: %w", name, stateID, ErrNotFound)
+	}
+
+	written := snap.state.Written
+	return []*StateVersion{
+		{
+			Version: snap.state.Version,
+			Created: &written,
+			Size:    len(snap.state.Blob),
+			MD5:     blobMD5(snap.state.Blob),
+			Deleted: snap.state.Deleted,
+		},
+	}, false, nil
+}
+
+// WaitForUnlock watches the lock key until it's deleted
+// that's an unlock as well as an expired lease
+func (es *etcdStore) WaitForUnlock(stateID string, name string, maxWait time.Duration) error {
+	if maxWait > lockListenInterval {
+		maxWait = lockListenInterval
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), maxWait)
+	defer cancel()
+	lockKey := es.lockKey(stateID, name)
+	resp, err := es.client.Get(ctx, lockKey)
+	if err != nil || len(resp.Kvs) == 0 {
+		// the caller tries to take the lock again either way
+		return nil
+	}
+
+	for watch := range es.client.Watch(ctx, lockKey, clientv3.WithRev(resp.Header.Revision+1)) {
+		for _, event := range watch.Events {
+			if event.Type == clientv3.EventTypeDelete {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (es *etcdStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	_, err := es.writeState(stateID, name, lockID, make([]byte, 0), force, expectedVersion, "", "", true, false)
+	return err
+}
+
+// UndeleteState restores the state before the latest delete
+// like in the memory store there is no recovery window
+func (es *etcdStore) UndeleteState(stateID string, name string) (int, error) {
+	var version int
+	err := es.update(stateID, name, func(snap *etcdSnapshot) ([]clientv3.Op, error) {
+		if snap.state == nil {
+			return nil, fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if !snap.state.Deleted {
+			return nil, fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotDeleted)
+		} else if snap.lockInfo() != "" {
+			return nil, lockedError(snap.lockInfo())
+		}
+
+		state := snap.latest()
+		state.Version++
+		state.Blob = state.DeletedBlob
+		state.Deleted = false
+		state.DeletedBlob = nil
+		state.Written = time.Now()
+		put, err := putJSON(snap.stateKey, state)
+		if err != nil {
+			return nil, err
+		}
+
+		version = state.Version
+		return []clientv3.Op{put}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// PurgeState deletes the state and its lock
+func (es *etcdStore) PurgeState(stateID string, name string, force bool) error {
+	var lease clientv3.LeaseID
+	err := es.update(stateID, name, func(snap *etcdSnapshot) ([]clientv3.Op, error) {
+		if snap.state == nil && snap.lock == nil {
+			return nil, fmt.Errorf("Can't purge [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if snap.lockInfo() != "" && !force {
+			return nil, lockedError(snap.lockInfo())
+		}
+
+		lease = snap.lease
+		return []clientv3.Op{clientv3.OpDelete(snap.stateKey), clientv3.OpDelete(snap.lockKey)}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	es.revoke(lease)
+	return nil
+}
+
+// CopyState writes the latest blob of a state as the first version of another one
+// neither of them may change until the copy is written
+func (es *etcdStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	for attempt := 1; attempt <= etcdTxnAttempts; attempt++ {
+		src, err := es.read(ctx, srcID, srcName)
+		if err != nil {
+			return err
+		} else if src.state == nil || len(src.state.Blob) == 0 {
+			return fmt.Errorf("Can't copy [%s] [%s]: %w", srcName, srcID, ErrNotFound)
+		} else if src.lockInfo() != "" {
+			return lockedError(src.lockInfo())
+		}
+
+		dst, err := es.read(ctx, dstID, dstName)
+		if err != nil {
+			return err
+		} else if dst.lockInfo() != "" {
+			return lockedError(dst.lockInfo())
+		} else if dst.state != nil {
+			return fmt.Errorf("Can't copy to [%s] [%s]: %w", dstName, dstID, ErrAlreadyExists)
+		}
+
+		put, err := putJSON(dst.stateKey, &etcdState{
+			Version: 1,
+			Blob:    src.state.Blob,
+			Written: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		resp, err := es.client.Txn(ctx).If(append(src.unchanged(), dst.unchanged()...)...).Then(put).Commit()
+		if err != nil {
+			return err
+		} else if resp.Succeeded {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Can't copy [%s] [%s]: %w", srcName, srcID, ErrVersionConflict)
+}
+
+// Compact has nothing to do because only the latest version is kept
+// etcd compacts its own history
+func (es *etcdStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	return make([]*CompactionResult, 0), nil
+}
+
+func (es *etcdStore) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	_, err := es.client.Get(ctx, es.prefix+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	return err
+}
+
+// Ping reads a single key instead of counting all of them
+func (es *etcdStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), es.timeout)
+	defer cancel()
+	_, err := es.client.Get(ctx, es.prefix, clientv3.WithCountOnly())
+	return err
+}
+
+func (es *etcdStore) Close() {
+	err := es.client.Close()
+	if err != nil {
+		logrus.Errorf("Can't close etcd client: %s", err.Error())
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the backends New knows how to create
+const (
+	BackendPostgres = "postgres"
+	// keeps states in process memory, they are gone after a restart
+	BackendMemory = "memory"
+	// locks live on etcd leases and expire with them
+	BackendEtcd = "etcd"
+)
+
+// Config carries the settings of all backends
+// every backend only looks at its own part
+type Config struct {
+	// connection string of the postgres backend
+	DatabaseURL string
+	Postgres    PostgresOptions
+	Etcd        EtcdOptions
+}
+
+// New creates the store of the given backend type
+// wrappers like the circuit breaker or the cache are up to the caller
+func New(backendType string, cfg Config) (Store, error) {
+	switch backendType {
+	case "", BackendPostgres:
+		logrus.Infof("Connecting to postgres at %s", RedactDSN(cfg.DatabaseURL))
+		ps, err := NewPostgresStore(cfg.DatabaseURL, cfg.Postgres)
+		if err != nil {
+			// don't hand out a typed nil
+			return nil, err
+		}
+
+		return ps, nil
+	case BackendMemory:
+		logrus.Warn("States are kept in memory and won't survive a restart")
+		return NewMemoryStore(), nil
+	case BackendEtcd:
+		logrus.Infof("Connecting to etcd at %v", cfg.Etcd.Endpoints)
+		es, err := NewEtcdStore(cfg.Etcd)
+		if err != nil {
+			return nil, err
+		}
+
+		return es, nil
+	default:
+		return nil, fmt.Errorf("Unknown backend [%s]", backendType)
+	}
+}
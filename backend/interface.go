@@ -16,15 +16,84 @@
 
 package backend
 
-import "errors"
+import "time"
 
-var ErrAlreadyLocked = errors.New("Already locked")
+// StateRef addresses a state
+type StateRef struct {
+	StateID string `json:"state_id"`
+	Name    string `json:"name"`
+}
+
+// VersionedState is the latest version of a state
+type VersionedState struct {
+	StateID string
+	Name    string
+	Version int
+	Data    []byte
+}
+
+// StateVersion describes one version of a state without its data
+type StateVersion struct {
+	Version int `json:"version"`
+	// nil for versions written before tf-locker kept track
+	Created *time.Time `json:"created,omitempty"`
+	// compressed versions report what they take up in the database
+	Size    int    `json:"size"`
+	MD5     string `json:"md5"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// CompactionResult is the number of old versions removed from a state
+// and the number of versions that were compressed
+type CompactionResult struct {
+	StateID            string `json:"state_id"`
+	Name               string `json:"name"`
+	RowsRemoved        int    `json:"rows_removed"`
+	VersionsCompressed int    `json:"versions_compressed,omitempty"`
+}
+
+// WriteResult is what a write of a state did
+type WriteResult struct {
+	// the version the write was stored as
+	Version int
+	// strictly increasing per state, handed out in the same transaction as the version
+	// a retried write with the same idempotency key gets the serial of the original
+	Serial int64
+	// a state is created by the first write that brings in data
+	Created bool
+}
 
 type Store interface {
-	UpsertState(stateID string, name string, lockID string, data []byte) error
+	UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error)
+	ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error)
+	CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error)
 	GetState(stateID string, name string) ([]byte, error)
-	LockState(stateID string, name string, lockInfo string) error
+	GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error)
+	GetLockInfo(stateID string, name string) (*LockInfo, error)
+	VerifyLock(stateID string, name string, lockID string) error
+	StateExists(stateID string, name string) (bool, error)
+	// StateSize is the size of the latest version of a state, zero if it has no data
+	StateSize(stateID string, name string) (int, error)
+	GetStates(refs []StateRef) ([]*VersionedState, error)
+	LockState(stateID string, name string, lockInfo string, owner string) (string, error)
+	LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error)
 	UnlockState(stateID string, name string, lockID string) error
-	DeleteState(stateID string, name string) error
+	ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error)
+	ListLocks() ([]*StateLock, error)
+	ListOrphanedLocks() ([]*StateLock, error)
+	ListWorkspaces(name string) ([]string, error)
+	ListNames(prefix string) ([]string, error)
+	// ListVersions describes the latest limit versions, the latest first
+	// more tells whether there are older ones, a limit of zero lists all of them
+	ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error)
+	WaitForUnlock(stateID string, name string, maxWait time.Duration) error
+	DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error
+	UndeleteState(stateID string, name string) (int, error)
+	PurgeState(stateID string, name string, force bool) error
+	CopyState(srcID string, srcName string, dstID string, dstName string) error
+	Compact(retention int, vacuum bool) ([]*CompactionResult, error)
+	CheckHealth() error
+	// Ping only checks that the backend answers, it's cheaper than CheckHealth
+	Ping() error
 	Close()
 }
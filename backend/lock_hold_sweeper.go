@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// how often held locks are checked against the maximum hold duration
+	lockHoldSweepInterval = 1 * time.Minute
+
+	locksOverdueGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tf_locker_locks_overdue",
+		Help: "Number of locks held longer than the maximum lock hold duration",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(locksOverdueGauge)
+}
+
+// overdueLock is what the webhook receives for every lock held too long
+type overdueLock struct {
+	*StateLock
+	HeldFor  string `json:"held_for"`
+	Released bool   `json:"released"`
+}
+
+// lockHoldSweeper looks for locks that have been held longer than maxHold
+// those are usually CI jobs that got stuck or were killed without unlocking
+// every overdue lock is reported once, optionally it's released right away
+type lockHoldSweeper struct {
+	store   Store
+	maxHold time.Duration
+	webhook string
+	release bool
+	client  *http.Client
+	// ids of the overdue locks that have been reported already
+	reported map[string]bool
+}
+
+func newLockHoldSweeper(store Store, maxHold time.Duration, webhook string, release bool) *lockHoldSweeper {
+	return &lockHoldSweeper{
+		store:    store,
+		maxHold:  maxHold,
+		webhook:  webhook,
+		release:  release,
+		client:   &http.Client{Timeout: timeout},
+		reported: make(map[string]bool),
+	}
+}
+
+// run sweeps until stop is closed
+func (lhs *lockHoldSweeper) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(lockHoldSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := lhs.sweep()
+			if err != nil {
+				logrus.Errorf("Can't sweep overdue locks: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (lhs *lockHoldSweeper) sweep() error {
+	locks, err := lhs.store.ListLocks()
+	if err != nil {
+		return err
+	}
+
+	overdue := 0
+	stillHeld := make(map[string]bool)
+	for _, lock := range locks {
+		// old locks taken with only an id don't say when they were taken
+		if lock.HeldSince().IsZero() {
+			continue
+		}
+
+		heldFor := time.Since(lock.HeldSince())
+		if heldFor <= lhs.maxHold {
+			continue
+		}
+
+		overdue++
+		stillHeld[lock.LockInfo.ID] = true
+		if lhs.reported[lock.LockInfo.ID] {
+			continue
+		}
+
+		lhs.reported[lock.LockInfo.ID] = true
+		lhs.handleOverdue(lock, heldFor)
+	}
+
+	// forget the locks that have been released in the meantime
+	for id := range lhs.reported {
+		if !stillHeld[id] {
+			delete(lhs.reported, id)
+		}
+	}
+
+	locksOverdueGauge.Set(float64(overdue))
+	return nil
+}
+
+func (lhs *lockHoldSweeper) handleOverdue(lock *StateLock, heldFor time.Duration) {
+	logrus.Warnf("Lock [%s] on [%s] [%s] taken by [%s] for %s has been held for %s", lock.LockInfo.ID, lock.Name, lock.StateID, lock.LockInfo.Who, lock.LockInfo.Operation, heldFor.Round(time.Second))
+
+	released := false
+	if lhs.release {
+		_, err := lhs.store.ForceUnlock(lock.StateID, lock.Name, lock.LockInfo.ID, false)
+		if err != nil {
+			logrus.Errorf("Can't release overdue lock [%s] on [%s] [%s]: %s", lock.LockInfo.ID, lock.Name, lock.StateID, err.Error())
+		} else {
+			logrus.Warnf("Released overdue lock [%s] on [%s] [%s]", lock.LockInfo.ID, lock.Name, lock.StateID)
+			released = true
+		}
+	}
+
+	if lhs.webhook == "" {
+		return
+	}
+
+	err := lhs.notify(&overdueLock{
+		StateLock: lock,
+		HeldFor:   heldFor.Round(time.Second).String(),
+		Released:  released,
+	})
+	if err != nil {
+		logrus.Errorf("Can't notify webhook about overdue lock [%s]: %s", lock.LockInfo.ID, err.Error())
+	}
+}
+
+func (lhs *lockHoldSweeper) notify(lock *overdueLock) error {
+	bites, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, lhs.webhook, bytes.NewReader(bites))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lhs.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered with %d", resp.StatusCode)
+	}
+
+	return nil
+}
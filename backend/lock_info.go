@@ -16,11 +16,16 @@
 
 package backend
 
-import "time"
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
 
 // LockInfo is virtually copy and pasted from hashicorps original
 // https://github.com/hashicorp/terraform/blob/master/state/state.go#L171
 // needless to say these two data structures need to be in sync
+// it has no json tags on purpose, terraform expects the plain field names in a 423 body
 type LockInfo struct {
 	// Unique ID for the lock. NewLockInfo provides a random ID, but this may
 	// be overridden by the lock implementation. The final value if ID will be
@@ -42,3 +47,133 @@ type LockInfo struct {
 	// Path to the state file when applicable. Set by the Lock implementation.
 	Path string
 }
+
+// StateLock is a lock currently held on a state
+type StateLock struct {
+	StateID  string    `json:"state_id"`
+	Name     string    `json:"name"`
+	LockInfo *LockInfo `json:"lock_info"`
+	// identity of the client that took the lock
+	Owner string `json:"owner,omitempty"`
+	// when the lock was taken according to tf-locker
+	// zero for locks taken before this was recorded
+	LockedAt time.Time `json:"locked_at"`
+	// the state never had data, the apply that took the lock died before writing
+	Orphaned bool `json:"orphaned,omitempty"`
+}
+
+// HeldSince is when a lock was taken
+// the time tf-locker recorded wins over the client supplied Created
+// it's zero if neither is known
+func (sl *StateLock) HeldSince() time.Time {
+	if !sl.LockedAt.IsZero() {
+		return sl.LockedAt
+	}
+
+	return sl.LockInfo.Created
+}
+
+// lockIDFromLockInfo extracts the lock id out of a lock info json
+// if the string isn't a lock info json, it's assumed to be the lock id itself
+func lockIDFromLockInfo(lockInfo string) string {
+	li := &LockInfo{}
+	err := json.Unmarshal([]byte(lockInfo), li)
+	if err == nil && li.ID != "" {
+		return li.ID
+	}
+
+	return strings.TrimSpace(lockInfo)
+}
+
+// verifyLockHolder checks that lockID is the id of the lock held
+// it returns ErrLockMismatch if somebody else holds it
+func verifyLockHolder(li *LockInfo, lockID string) error {
+	if li.ID != lockID {
+		return ErrLockMismatch
+	}
+
+	return nil
+}
+
+// LockedError is ErrAlreadyLocked carrying the lock that's in the way
+// terraform parses the LockInfo out of a 423 and shows it to the user that couldn't get the lock
+type LockedError struct {
+	LockInfo *LockInfo
+}
+
+func (le *LockedError) Error() string {
+	return ErrAlreadyLocked.Error() + ": " + le.LockInfo.describe()
+}
+
+func (le *LockedError) Unwrap() error {
+	return ErrAlreadyLocked
+}
+
+// LockMismatchError is ErrLockMismatch carrying the lock that's actually held
+// LockInfo is nil if nobody holds the lock
+type LockMismatchError struct {
+	LockInfo *LockInfo
+}
+
+func (lme *LockMismatchError) Error() string {
+	if lme.LockInfo == nil {
+		return ErrLockMismatch.Error() + ": state isn't locked"
+	}
+
+	return ErrLockMismatch.Error() + ": " + lme.LockInfo.describe()
+}
+
+func (lme *LockMismatchError) Unwrap() error {
+	return ErrLockMismatch
+}
+
+// lockMismatchError is ErrLockMismatch telling who holds the lock instead
+func lockMismatchError(lockInfo string) error {
+	return &LockMismatchError{LockInfo: storedLockInfo(lockInfo)}
+}
+
+// lockedError is ErrAlreadyLocked telling who holds the lock
+func lockedError(lockInfo string) error {
+	return &LockedError{LockInfo: parseLockInfo(lockInfo)}
+}
+
+// describe sums up a lock for humans
+func (li *LockInfo) describe() string {
+	description := "state is locked"
+	if li.Who != "" {
+		description += " by " + li.Who
+	}
+
+	if !li.Created.IsZero() {
+		description += " since " + li.Created.UTC().Format(time.RFC3339)
+	}
+
+	description += ", lock ID " + li.ID
+	if li.Operation != "" {
+		description += ", operation " + li.Operation
+	}
+
+	return description
+}
+
+// storedLockInfo is the LockInfo of a stored lock column
+// states that aren't locked store NULL, an empty string or blanks and get nil
+func storedLockInfo(lockInfo string) *LockInfo {
+	if strings.TrimSpace(lockInfo) == "" {
+		return nil
+	}
+
+	return parseLockInfo(lockInfo)
+}
+
+// parseLockInfo turns a stored lock into a LockInfo
+// locks that weren't taken with a lock info json only carry the id
+func parseLockInfo(lockInfo string) *LockInfo {
+	li := &LockInfo{}
+	err := json.Unmarshal([]byte(lockInfo), li)
+	if err != nil {
+		return &LockInfo{ID: lockInfo}
+	}
+
+	return li
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// terraform parses the body of a 423 into its statemgr.LockInfo
+// and shows who holds the lock, that only works with exactly these field names
+func TestLockInfoFieldNames(t *testing.T) {
+	li := &LockInfo{
+		ID:        "21372f90-cb29-bbdf-0fea-75240e6d00bc",
+		Operation: "OperationTypeApply",
+		Info:      "",
+		Who:       "alice@laptop",
+		Version:   "0.12.29",
+		Created:   time.Date(2018, 9, 6, 20, 8, 23, 0, time.UTC),
+		Path:      "",
+	}
+
+	bites, err := json.Marshal(li)
+	if err != nil {
+		t.Fatalf("Can't serialize lock info: %s", err.Error())
+	}
+
+	fields := make(map[string]interface{})
+	err = json.Unmarshal(bites, &fields)
+	if err != nil {
+		t.Fatalf("Can't parse lock info: %s", err.Error())
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	want := []string{"Created", "ID", "Info", "Operation", "Path", "Version", "Who"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("Lock info has the fields %v, terraform expects %v", names, want)
+	}
+
+	if fields["Created"] != "2018-09-06T20:08:23Z" {
+		t.Fatalf("Created is %v, terraform expects RFC 3339", fields["Created"])
+	}
+
+	// the lock info in a 423 is the one that was stored
+	locked := lockedError(string(bites))
+	le, ok := locked.(*LockedError)
+	if !ok || le.LockInfo.ID != li.ID || le.LockInfo.Who != li.Who || !le.LockInfo.Created.Equal(li.Created) {
+		t.Fatalf("423 carries %+v, want %+v", locked, li)
+	}
+}
@@ -0,0 +1,540 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stateKey struct {
+	stateID string
+	name    string
+}
+
+type memoryState struct {
+	version    int
+	blob       []byte
+	lockInfo   string
+	lockOwner  string
+	lockedAt   time.Time
+	lastLockID string
+	// when the latest version was written
+	written time.Time
+	// the blob before the latest version deleted the state
+	// nil if the latest version isn't a delete
+	deletedBlob []byte
+}
+
+type idempotencyKey struct {
+	key   string
+	state stateKey
+}
+
+type idempotentWrite struct {
+	version int
+	serial  int64
+	created time.Time
+}
+
+// memoryStore keeps the latest version of every state in process memory
+// it follows the same locking rules as the postgres store
+// and is meant for exercising the http layer without a database
+type memoryStore struct {
+	mutex           sync.Mutex
+	states          map[stateKey]*memoryState
+	notifier        *unlockNotifier
+	idempotentWrite map[idempotencyKey]*idempotentWrite
+	// kept apart from the states so that they survive purges
+	// every write takes the next one
+	serials map[stateKey]int64
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		states:          make(map[stateKey]*memoryState),
+		notifier:        newUnlockNotifier(),
+		idempotentWrite: make(map[idempotencyKey]*idempotentWrite),
+		serials:         make(map[stateKey]int64),
+	}
+}
+
+func (ms *memoryStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return ms.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, false)
+}
+
+func (ms *memoryStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	return ms.writeState(stateID, name, lockID, data, false, 0, expectedMD5, idempotencyKey, false, false)
+}
+
+func (ms *memoryStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return ms.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, true)
+}
+
+func (ms *memoryStore) writeState(stateID string, name string, lockID string, data []byte, force bool, expectedVersion int, expectedMD5 string, key string, deleted bool, unlock bool) (WriteResult, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	sk := stateKey{stateID, name}
+	ik := idempotencyKey{key, sk}
+	if key != "" {
+		previous, ok := ms.idempotentWrite[ik]
+		if ok && time.Since(previous.created) < DefaultIdempotencyKeyTTL {
+			return WriteResult{Version: previous.version, Serial: previous.serial}, nil
+		}
+	}
+
+	state, ok := ms.states[sk]
+	if !ok {
+		state = &memoryState{}
+	} else if state.lockInfo != "" && lockIDFromLockInfo(state.lockInfo) != lockID && !force {
+		return WriteResult{}, lockedError(state.lockInfo)
+	}
+
+	if unlock && (lockID == "" || state.lockInfo == "") {
+		return WriteResult{}, fmt.Errorf("Can't unlock [%s] [%s] after the write: %w", name, stateID, ErrNotLocked)
+	}
+
+	if expectedVersion != 0 && state.version != expectedVersion {
+		return WriteResult{}, ErrPreconditionFailed
+	}
+
+	if expectedMD5 != "" && (state.version == 0 || blobMD5(state.blob) != expectedMD5) {
+		return WriteResult{}, ErrPreconditionFailed
+	}
+
+	ms.states[sk] = state
+	created := len(state.blob) == 0
+
+	state.deletedBlob = nil
+	if deleted {
+		state.deletedBlob = append(make([]byte, 0, len(state.blob)), state.blob...)
+	}
+
+	state.version++
+	state.blob = append(make([]byte, 0, len(data)), data...)
+	state.written = time.Now()
+	if lockID == "" && state.lockInfo != "" {
+		state.lockInfo = ""
+		state.lockOwner = ""
+		ms.notifier.notify(sk)
+	} else if unlock {
+		state.lockInfo = ""
+		state.lockOwner = ""
+		state.lastLockID = lockIDFromLockInfo(lockID)
+		ms.notifier.notify(sk)
+	}
+
+	ms.serials[sk]++
+	result := WriteResult{Version: state.version, Serial: ms.serials[sk], Created: created}
+	if key != "" {
+		ms.idempotentWrite[ik] = &idempotentWrite{
+			version: result.Version,
+			serial:  result.Serial,
+			created: time.Now(),
+		}
+	}
+
+	return result, nil
+}
+
+func (ms *memoryStore) GetState(stateID string, name string) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return make([]byte, 0), nil
+	}
+
+	return append(make([]byte, 0, len(state.blob)), state.blob...), nil
+}
+
+func (ms *memoryStore) GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return make([]byte, 0), nil, nil
+	}
+
+	return append(make([]byte, 0, len(state.blob)), state.blob...), storedLockInfo(state.lockInfo), nil
+}
+
+func (ms *memoryStore) GetLockInfo(stateID string, name string) (*LockInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok || state.lockInfo == "" {
+		return nil, ErrNotLocked
+	}
+
+	return parseLockInfo(state.lockInfo), nil
+}
+
+func (ms *memoryStore) VerifyLock(stateID string, name string, lockID string) error {
+	li, err := ms.GetLockInfo(stateID, name)
+	if err != nil {
+		return err
+	}
+
+	return verifyLockHolder(li, lockID)
+}
+
+func (ms *memoryStore) GetStates(refs []StateRef) ([]*VersionedState, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	states := make([]*VersionedState, 0, len(refs))
+	for _, ref := range refs {
+		state, ok := ms.states[stateKey{ref.StateID, ref.Name}]
+		if !ok || len(state.blob) == 0 {
+			continue
+		}
+
+		states = append(states, &VersionedState{
+			StateID: ref.StateID,
+			Name:    ref.Name,
+			Version: state.version,
+			Data:    append(make([]byte, 0, len(state.blob)), state.blob...),
+		})
+	}
+
+	return states, nil
+}
+
+func (ms *memoryStore) StateExists(stateID string, name string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	return ok && len(state.blob) > 0, nil
+}
+
+func (ms *memoryStore) StateSize(stateID string, name string) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return 0, nil
+	}
+
+	return len(state.blob), nil
+}
+
+func (ms *memoryStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	_, err := ms.writeState(stateID, name, lockID, make([]byte, 0), force, expectedVersion, "", "", true, false)
+	return err
+}
+
+func (ms *memoryStore) PurgeState(stateID string, name string, force bool) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	sk := stateKey{stateID, name}
+	state, ok := ms.states[sk]
+	if !ok {
+		return fmt.Errorf("Can't purge [%s] [%s]: %w", name, stateID, ErrNotFound)
+	} else if state.lockInfo != "" && !force {
+		return lockedError(state.lockInfo)
+	}
+
+	delete(ms.states, sk)
+	for ik := range ms.idempotentWrite {
+		if ik.state == sk {
+			delete(ms.idempotentWrite, ik)
+		}
+	}
+
+	if state.lockInfo != "" {
+		ms.notifier.notify(sk)
+	}
+	return nil
+}
+
+// UndeleteState restores the state before the latest delete
+// there is no recovery window, deleted states are kept until they are written again
+func (ms *memoryStore) UndeleteState(stateID string, name string) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return 0, fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotFound)
+	} else if state.deletedBlob == nil {
+		return 0, fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotDeleted)
+	} else if state.lockInfo != "" {
+		return 0, lockedError(state.lockInfo)
+	}
+
+	state.version++
+	state.blob = state.deletedBlob
+	state.deletedBlob = nil
+	state.written = time.Now()
+	return state.version, nil
+}
+
+// CopyState writes the latest blob of a state as the first version of another one
+func (ms *memoryStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	src, ok := ms.states[stateKey{srcID, srcName}]
+	if !ok || len(src.blob) == 0 {
+		return fmt.Errorf("Can't copy [%s] [%s]: %w", srcName, srcID, ErrNotFound)
+	} else if src.lockInfo != "" {
+		return lockedError(src.lockInfo)
+	}
+
+	dst, ok := ms.states[stateKey{dstID, dstName}]
+	if ok && dst.lockInfo != "" {
+		return lockedError(dst.lockInfo)
+	} else if ok {
+		return fmt.Errorf("Can't copy to [%s] [%s]: %w", dstName, dstID, ErrAlreadyExists)
+	}
+
+	ms.states[stateKey{dstID, dstName}] = &memoryState{
+		version: 1,
+		blob:    append(make([]byte, 0, len(src.blob)), src.blob...),
+		written: time.Now(),
+	}
+	return nil
+}
+
+func (ms *memoryStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	err := ms.lockState(stateID, name, lockInfo, owner)
+	if err != nil {
+		return "", err
+	}
+
+	return lockIDFromLockInfo(lockInfo), nil
+}
+
+func (ms *memoryStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	err := ms.lockState(stateID, name, lockInfo, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	state := ms.states[stateKey{stateID, name}]
+	return append(make([]byte, 0, len(state.blob)), state.blob...), nil
+}
+
+// lockState needs to be called with the mutex held
+func (ms *memoryStore) lockState(stateID string, name string, lockInfo string, owner string) error {
+	key := stateKey{stateID, name}
+	state, ok := ms.states[key]
+	if !ok {
+		ms.states[key] = &memoryState{
+			version:   1,
+			blob:      make([]byte, 0),
+			lockInfo:  lockInfo,
+			lockOwner: owner,
+			lockedAt:  time.Now(),
+			written:   time.Now(),
+		}
+		return nil
+	}
+
+	// a re-lock by the holder refreshes when the lock was taken
+	if state.lockInfo != "" && state.lockInfo != lockInfo {
+		return lockedError(state.lockInfo)
+	}
+
+	state.lockInfo = lockInfo
+	state.lockOwner = owner
+	state.lockedAt = time.Now()
+	return nil
+}
+
+func (ms *memoryStore) UnlockState(stateID string, name string, lockID string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	requestedLockID := lockIDFromLockInfo(lockID)
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return fmt.Errorf("Can't unlock [%s] [%s]: %w", name, stateID, ErrNotFound)
+	} else if state.lockInfo == "" && state.lastLockID == requestedLockID {
+		return nil
+	} else if lockIDFromLockInfo(state.lockInfo) != requestedLockID {
+		return fmt.Errorf("Can't unlock [%s] [%s] with lock [%s]: %w", name, stateID, lockID, lockMismatchError(state.lockInfo))
+	}
+
+	state.lockInfo = ""
+	state.lockOwner = ""
+	state.lastLockID = requestedLockID
+	ms.notifier.notify(stateKey{stateID, name})
+	return nil
+}
+
+func (ms *memoryStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok || state.lockInfo == "" {
+		return nil, ErrNotLocked
+	}
+
+	li := parseLockInfo(state.lockInfo)
+	if !override && li.ID != lockIDFromLockInfo(expectedLockID) {
+		return li, ErrLockMismatch
+	}
+
+	state.lockInfo = ""
+	state.lockOwner = ""
+	state.lastLockID = li.ID
+	ms.notifier.notify(stateKey{stateID, name})
+	return li, nil
+}
+
+func (ms *memoryStore) ListLocks() ([]*StateLock, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.listLocks(func(state *memoryState) bool {
+		return state.lockInfo != ""
+	}), nil
+}
+
+// ListOrphanedLocks returns the locked states that were never written
+// LOCK creates them with an empty first version
+func (ms *memoryStore) ListOrphanedLocks() ([]*StateLock, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	orphaned := func(state *memoryState) bool {
+		return state.lockInfo != "" && state.version == 1 && len(state.blob) == 0
+	}
+	locks := ms.listLocks(orphaned)
+	for _, lock := range locks {
+		lock.Orphaned = true
+	}
+
+	return locks, nil
+}
+
+// listLocks needs to be called with the mutex held
+func (ms *memoryStore) listLocks(match func(state *memoryState) bool) []*StateLock {
+	locks := make([]*StateLock, 0)
+	for key, state := range ms.states {
+		if !match(state) {
+			continue
+		}
+
+		locks = append(locks, &StateLock{
+			StateID:  key.stateID,
+			Name:     key.name,
+			LockInfo: parseLockInfo(state.lockInfo),
+			Owner:    state.lockOwner,
+			LockedAt: state.lockedAt,
+		})
+	}
+
+	return locks
+}
+
+func (ms *memoryStore) ListWorkspaces(name string) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	stateNames := make([]string, 0)
+	for key, state := range ms.states {
+		if len(state.blob) == 0 {
+			continue
+		}
+
+		if key.name == name || strings.HasPrefix(key.name, name+WorkspaceSeparator) {
+			stateNames = append(stateNames, key.name)
+		}
+	}
+
+	return workspacesFromStateNames(name, stateNames), nil
+}
+
+// ListVersions only knows the latest version, the memory store keeps no history
+func (ms *memoryStore) ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state, ok := ms.states[stateKey{stateID, name}]
+	if !ok {
+		return nil, false, fmt.Errorf("No versions of [%s] [%s]: %w", name, stateID, ErrNotFound)
+	}
+
+	written := state.written
+	return []*StateVersion{
+		{
+			Version: state.version,
+			Created: &written,
+			Size:    len(state.blob),
+			MD5:     blobMD5(state.blob),
+			Deleted: state.deletedBlob != nil,
+		},
+	}, false, nil
+}
+
+func (ms *memoryStore) ListNames(prefix string) ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	stateNames := make([]string, 0)
+	for key, state := range ms.states {
+		if len(state.blob) > 0 && strings.HasPrefix(key.name, prefix) {
+			stateNames = append(stateNames, key.name)
+		}
+	}
+
+	return uniqueSortedNames(stateNames), nil
+}
+
+func (ms *memoryStore) WaitForUnlock(stateID string, name string, maxWait time.Duration) error {
+	// an unlock might have happened right before we subscribed
+	if maxWait > lockPollInterval {
+		maxWait = lockPollInterval
+	}
+
+	ms.notifier.wait(stateKey{stateID, name}, maxWait)
+	return nil
+}
+
+// Compact has nothing to do because only the latest version is kept
+func (ms *memoryStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	return make([]*CompactionResult, 0), nil
+}
+
+func (ms *memoryStore) CheckHealth() error {
+	return nil
+}
+
+func (ms *memoryStore) Ping() error {
+	return nil
+}
+
+func (ms *memoryStore) Close() {}
@@ -20,16 +20,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	// all go postgres driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	tableCreationQuery = `CREATE TABLE IF NOT EXISTS states
+	tableCreationQuery = `CREATE TABLE IF NOT EXISTS {states}
 (
 	state_id UUID NOT NULL,
 	name VARCHAR(64) NOT NULL,
@@ -39,107 +41,1261 @@ const (
 	PRIMARY KEY (state_id, name, version)
 )`
 
-	upsertSelectForUpdateStr = "SELECT version, lock_info FROM states WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
-	upsertInsertStr          = "INSERT INTO states(state_id, name, version, lock_info, blob) VALUES($1, $2, $3, $4, $5)"
-	getSelectStr             = "SELECT version, blob FROM states WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1"
-	lockUpdateStr            = "UPDATE states SET lock_info = $1 WHERE state_id = $2 AND name = $3 AND version = $4"
+	upsertSelectForUpdateStr     = "SELECT version, lock_info, locked_by, locked_at FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	writeSelectForUpdateStr      = "SELECT version, lock_info, locked_by, locked_at, COALESCE(octet_length(blob), 0) = 0 OR deleted_at IS NOT NULL FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	upsertInsertStr              = "INSERT INTO {states}(state_id, name, version, lock_info, blob, locked_by, deleted_at, locked_at, blob_md5) VALUES($1, $2, {version}, $4, $5, $6, CASE WHEN $7 THEN now() END, $8, $9) ON CONFLICT (state_id, name, version) DO NOTHING RETURNING version"
+	lockInsertStr                = "INSERT INTO {states}(state_id, name, version, lock_info, blob, locked_by, locked_at) VALUES($1, $2, $3, $4, $5, $6, now()) ON CONFLICT (state_id, name, version) DO NOTHING"
+	getAndLockSelectStr          = "SELECT blob, lock_info, deleted_at IS NOT NULL FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1"
+	lockInfoSelectStr            = "SELECT lock_info FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1"
+	getSelectStr                 = "SELECT version, blob, deleted_at IS NOT NULL FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1"
+	existsSelectStr              = "SELECT EXISTS(SELECT 1 FROM (SELECT blob FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1) latest WHERE latest.blob <> '')"
+	sizeSelectStr                = "SELECT COALESCE((SELECT octet_length(blob) FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1), 0)"
+	listLocksSelectStr           = "SELECT state_id, name, lock_info, locked_by, locked_at FROM (SELECT DISTINCT ON (state_id, name) state_id, name, lock_info, locked_by, locked_at FROM {states} ORDER BY state_id, name, version DESC) latest WHERE lock_info IS NOT NULL AND lock_info <> ''"
+	listOrphanedLocksSelectStr   = "SELECT state_id, name, lock_info, locked_by, locked_at FROM (SELECT DISTINCT ON (state_id, name) state_id, name, lock_info, locked_by, locked_at FROM {states} ORDER BY state_id, name, version DESC) latest WHERE lock_info IS NOT NULL AND lock_info <> '' AND NOT EXISTS (SELECT 1 FROM {states} written WHERE written.state_id = latest.state_id AND written.name = latest.name AND written.blob <> '')"
+	listWorkspacesSelectStr      = "SELECT name FROM (SELECT DISTINCT ON (state_id, name) name, blob FROM {states} WHERE name = $1 OR name LIKE $2 ORDER BY state_id, name, version DESC) latest WHERE latest.blob <> ''"
+	listNamesSelectStr           = "SELECT DISTINCT name FROM (SELECT DISTINCT ON (state_id, name) name, blob FROM {states} WHERE name LIKE $1 ORDER BY state_id, name, version DESC) latest WHERE latest.blob <> ''"
+	schemaCheckStr               = "SELECT 1 FROM {states} LIMIT 1"
+	batchSelectStr               = "SELECT DISTINCT ON (state_id, name) state_id, name, version, blob FROM {states} WHERE (state_id, name) IN (%s) ORDER BY state_id, name, version DESC"
+	compactDeleteStr             = "DELETE FROM {states} s USING (SELECT state_id, name, version, ROW_NUMBER() OVER (PARTITION BY state_id, name ORDER BY version DESC) AS rn FROM {states}) ranked WHERE s.state_id = ranked.state_id AND s.name = ranked.name AND s.version = ranked.version AND ranked.rn > $1 RETURNING s.state_id, s.name"
+	compressSelectStr            = "SELECT state_id, name, version FROM (SELECT state_id, name, version, blob, ROW_NUMBER() OVER (PARTITION BY state_id, name ORDER BY version DESC) AS rn FROM {states}) ranked WHERE ranked.rn > 1 AND ascii(ranked.blob) > 8"
+	compressBlobSelectStr        = "SELECT blob FROM {states} WHERE state_id = $1 AND name = $2 AND version = $3 AND ascii(blob) > 8 FOR UPDATE"
+	compressUpdateStr            = "UPDATE {states} SET blob = $1, blob_md5 = COALESCE(blob_md5, $2) WHERE state_id = $3 AND name = $4 AND version = $5"
+	vacuumStr                    = "VACUUM ANALYZE {states}"
+	idempotencySelectStr         = "SELECT version, COALESCE(serial, 0) FROM idempotency_keys WHERE idempotency_key = $1 AND state_id = $2 AND name = $3 AND created_at > now() - $4 * interval '1 second'"
+	idempotencyInsertStr         = "INSERT INTO idempotency_keys(idempotency_key, state_id, name, version, serial) VALUES($1, $2, $3, $4, $5) ON CONFLICT (idempotency_key, state_id, name) DO UPDATE SET version = EXCLUDED.version, serial = EXCLUDED.serial, created_at = now()"
+	serialUpsertStr              = "INSERT INTO state_serials(state_id, name, serial) VALUES($1, $2, 1) ON CONFLICT (state_id, name) DO UPDATE SET serial = state_serials.serial + 1 RETURNING serial"
+	idempotencyExpireStr         = "DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'"
+	lockUpdateStr                = "UPDATE {states} SET lock_info = $1, locked_by = $2, locked_at = now() WHERE state_id = $3 AND name = $4 AND version = $5"
+	unlockSelectForUpdateStr     = "SELECT version, lock_info, last_lock_id FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	unlockUpdateStr              = "UPDATE {states} SET lock_info = NULL, locked_by = NULL, locked_at = NULL, last_lock_id = $1 WHERE state_id = $2 AND name = $3 AND version = $4"
+	unlockNotifyStr              = "SELECT pg_notify($1, $2)"
+	undeleteSelectForUpdateStr   = "SELECT version, lock_info, deleted_at IS NOT NULL, COALESCE(deleted_at > now() - $3 * interval '1 second', false) FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	undeletePreviousSelectStr    = "SELECT blob FROM {states} WHERE state_id = $1 AND name = $2 AND version < $3 ORDER BY version DESC LIMIT 1"
+	copySourceSelectForUpdateStr = "SELECT blob, lock_info, deleted_at IS NOT NULL FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	copyTargetSelectStr          = "SELECT lock_info FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1"
+	creationLockStr              = "SELECT pg_advisory_xact_lock(hashtext($1), hashtext($2))"
+	copyInsertStr                = "INSERT INTO {states}(state_id, name, version, blob, blob_md5) VALUES($1, $2, 1, $3, $4)"
+	listVersionsSelectStr        = "SELECT version, created_at, octet_length(blob), COALESCE(blob_md5, encode(decode(md5(blob), 'hex'), 'base64')), deleted_at IS NOT NULL FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT $3"
+	versionBlobSelectStr         = "SELECT blob FROM {states} WHERE state_id = $1 AND name = $2 AND version = $3"
+	purgeSelectForUpdateStr      = "SELECT lock_info FROM {states} WHERE state_id = $1 AND name = $2 ORDER BY version DESC LIMIT 1 FOR UPDATE"
+	purgeDeleteStr               = "DELETE FROM {states} WHERE state_id = $1 AND name = $2"
+	purgeIdempotencyDeleteStr    = "DELETE FROM idempotency_keys WHERE state_id = $1 AND name = $2"
+	purgeDeletedStr              = "DELETE FROM {states} s USING (SELECT DISTINCT ON (state_id, name) state_id, name, deleted_at FROM {states} ORDER BY state_id, name, version DESC) latest WHERE s.state_id = latest.state_id AND s.name = latest.name AND latest.deleted_at < now() - $1 * interval '1 second'"
+
+	// queries name the version of a new row with this placeholder
+	// $3 is the version after the latest one
+	versionPlaceholder = "{version}"
+
+	// channel unlocks are announced on
+	// the payload is a json object carrying state_id and name
+	unlockChannel = "tf_locker_unlock"
+)
+
+// schemaMigrations are applied in order after the tables have been created
+// migrations of the states table run against every shard
+// every statement needs to be safe to run against an already migrated table
+var schemaMigrations = []string{
+	// remembers who held the lock last so that retried unlocks succeed
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS last_lock_id TEXT",
+	// the authenticated client that took the lock
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS locked_by TEXT",
+	// writes that have been done already, keyed by the clients idempotency key
+	`CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+	idempotency_key VARCHAR(255) NOT NULL,
+	state_id UUID NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	version BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (idempotency_key, state_id, name)
+)`,
+	"CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at)",
+	// when a state was soft-deleted, set on the empty version a delete writes
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ",
+	// hands out versions for the sequence version strategy
+	"CREATE SEQUENCE IF NOT EXISTS state_versions",
+	// when the lock was taken according to the database clock
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS locked_at TIMESTAMPTZ",
+	// the schema versions that have been applied to this database
+	`CREATE TABLE IF NOT EXISTS schema_version
+(
+	version INT NOT NULL PRIMARY KEY,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`,
+	// when a version was written, versions from before the migration don't know
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ",
+	"ALTER TABLE {states} ALTER COLUMN created_at SET DEFAULT now()",
+	// md5 of the blob so that listing versions doesn't need to read every blob
+	// versions from before the migration have it computed when they are listed
+	"ALTER TABLE {states} ADD COLUMN IF NOT EXISTS blob_md5 TEXT",
+	// serials handed out to writes, they survive purges so they never go back
+	`CREATE TABLE IF NOT EXISTS state_serials
+(
+	state_id UUID NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	serial BIGINT NOT NULL,
+	PRIMARY KEY (state_id, name)
+)`,
+	// the serial of the write a key belongs to, retries get it back
+	// keys from before the migration don't know it
+	"ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS serial BIGINT",
+	// compaction used to mark the old versions it gzipped in a blob_compressed column
+	// those versions get the gzip header every other blob format reader knows
+	`DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = '{states}' AND column_name = 'blob_compressed') THEN
+		UPDATE {states} SET blob = chr(1) || blob WHERE blob_compressed AND ascii(blob) > 8;
+		ALTER TABLE {states} DROP COLUMN blob_compressed;
+	END IF;
+END
+$$`,
+}
+
+// SchemaVersion is the version of the schema this binary needs
+// bump it whenever a migration is added to schemaMigrations
+const SchemaVersion = 7
+
+// expectedColumns are the columns of the states table queries rely on and their types
+// as information_schema names them, new columns need to be added here
+// queries always name their columns, order and additional columns don't matter
+var expectedColumns = map[string]string{
+	"state_id":     "uuid",
+	"name":         "character varying",
+	"version":      "bigint",
+	"lock_info":    "text",
+	"blob":         "text",
+	"last_lock_id": "text",
+	"locked_by":    "text",
+	"deleted_at":   "timestamp with time zone",
+	"locked_at":    "timestamp with time zone",
+	"created_at":   "timestamp with time zone",
+	"blob_md5":     "text",
+}
+
+const (
+	schemaVersionInsertStr = "INSERT INTO schema_version (version) VALUES ($1) ON CONFLICT DO NOTHING"
+	schemaVersionSelectStr = "SELECT COALESCE(MAX(version), 0) FROM schema_version"
+	columnsSelectStr       = "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1"
+)
+
+// Version strategies decide which version a new row of a state gets.
+// Versions always grow per state, whatever the strategy.
+const (
+	// the version after the latest one, that's what tf-locker always did
+	// two writers creating the same state at once get the same version
+	// and one of them fails with ErrVersionConflict
+	VersionIncrement = "increment"
+	// versions come from a postgres sequence
+	// concurrent writers never get the same version
+	VersionSequence = "sequence"
+	// the time of the write in microseconds since the epoch
+	VersionTimestamp = "timestamp"
+)
+
+// versionExpressions computes the version of a new row for each strategy
+// taking the greater of the two keeps versions growing
+// when a state was written with a different strategy before
+var versionExpressions = map[string]string{
+	VersionIncrement: "$3",
+	VersionSequence:  "GREATEST(nextval('state_versions'), $3)",
+	VersionTimestamp: "GREATEST((extract(epoch from clock_timestamp()) * 1000000)::bigint, $3)",
+}
+
+const (
+	// https://www.postgresql.org/docs/current/errcodes-appendix.html
+	pqUniqueViolation = pq.ErrorCode("23505")
+	pqUndefinedTable  = pq.ErrorCode("42P01")
 )
 
-var (
-	timeout time.Duration = 5 * time.Second
-)
+var (
+	// schema checks and QueryTimeouts without Default wait this long
+	timeout time.Duration = 5 * time.Second
+	// how often lock waiters look at the lock again
+	// without LISTEN this is the polling interval
+	// with LISTEN it is a safety net for missed notifications
+	lockPollInterval   = 1 * time.Second
+	lockListenInterval = 5 * time.Second
+	// maintenance touches the entire table and gets more time
+	maintenanceTimeout = 5 * time.Minute
+	// how often soft-deleted states past their recovery window are purged
+	deleteSweepInterval = 1 * time.Minute
+)
+
+// DefaultIdempotencyKeyTTL is how long idempotency keys are remembered by default
+const DefaultIdempotencyKeyTTL = 24 * time.Hour
+
+// DefaultWriteAttempts is how often a write is tried by default
+const DefaultWriteAttempts = 3
+
+// PostgresOptions tune the postgres store
+type PostgresOptions struct {
+	// how long the idempotency keys of writes are remembered
+	IdempotencyKeyTTL time.Duration
+	// number of tables states are spread over, see shards.go
+	// zero and one keep all states in a single table
+	Shards int
+	// how versions of new rows are picked
+	// empty means VersionIncrement
+	VersionStrategy string
+	// how long deleted states can be restored before they are purged for good
+	// zero turns soft-delete off, deleted states keep all their versions
+	// and GET returns an empty state like it always did
+	DeleteRecoveryWindow time.Duration
+	// locks held longer than this are reported, see lock_hold_sweeper.go
+	// zero turns the sweeper off
+	MaxLockHold time.Duration
+	// url overdue locks are posted to as json, empty means they are only logged
+	MaxLockHoldWebhook string
+	// release overdue locks instead of only reporting them
+	ReleaseOverdueLocks bool
+	// don't touch the schema and only verify it's at SchemaVersion
+	// for deployments that migrate with --init-db and run with fewer privileges
+	SkipMigrations bool
+	// how often a write is tried when concurrent writers take its version
+	// zero means DefaultWriteAttempts
+	WriteAttempts int
+	// how long operations wait for postgres
+	Timeouts QueryTimeouts
+	// compaction gzips all but the latest version of every state
+	// the latest version stays as it is so that GETs don't pay for it
+	CompressOldVersions bool
+	// how new versions are stored, see blob_format.go
+	// empty means BlobFormatPlain
+	BlobFormat string
+}
+
+// QueryTimeouts bound how long each kind of operation waits for postgres
+// a GET of a large state might need more time than a LOCK should ever take
+// zero falls back to Default and a zero Default to 5 seconds
+type QueryTimeouts struct {
+	Default time.Duration
+	// reads of states
+	Get time.Duration
+	// writes, deletes and copies
+	Write time.Duration
+	// taking, releasing and looking at locks
+	Lock time.Duration
+	// listings across states
+	List time.Duration
+}
+
+func (qt QueryTimeouts) withDefaults() QueryTimeouts {
+	if qt.Default <= 0 {
+		qt.Default = timeout
+	}
+
+	for _, t := range []*time.Duration{&qt.Get, &qt.Write, &qt.Lock, &qt.List} {
+		if *t <= 0 {
+			*t = qt.Default
+		}
+	}
+
+	return qt
+}
+
+type postgresStore struct {
+	db                *sql.DB
+	listener          *pq.Listener
+	notifier          *unlockNotifier
+	idempotencyKeyTTL time.Duration
+	tables            []string
+	upsertInsertStr   string
+	recoveryWindow    time.Duration
+	writeAttempts     int
+	timeouts          QueryTimeouts
+	compressOld       bool
+	blobFormat        string
+	stop              chan struct{}
+}
+
+type unlockPayload struct {
+	StateID string `json:"state_id"`
+	Name    string `json:"name"`
+}
+
+func NewPostgresStore(databaseUrl string, opts PostgresOptions) (*postgresStore, error) {
+	if opts.VersionStrategy == "" {
+		opts.VersionStrategy = VersionIncrement
+	}
+
+	versionExpression, ok := versionExpressions[opts.VersionStrategy]
+	if !ok {
+		return nil, fmt.Errorf("Unknown version strategy [%s]", opts.VersionStrategy)
+	}
+
+	if opts.WriteAttempts <= 0 {
+		opts.WriteAttempts = DefaultWriteAttempts
+	}
+
+	if opts.BlobFormat == "" {
+		opts.BlobFormat = BlobFormatPlain
+	} else if !validBlobFormat(opts.BlobFormat) {
+		return nil, fmt.Errorf("Unknown blob format [%s]", opts.BlobFormat)
+	}
+
+	tables := shardTables(opts.Shards)
+	db, err := connectToPostgres(databaseUrl, tables, !opts.SkipMigrations)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &postgresStore{
+		db:                db,
+		notifier:          newUnlockNotifier(),
+		idempotencyKeyTTL: opts.IdempotencyKeyTTL,
+		tables:            tables,
+		upsertInsertStr:   strings.Replace(upsertInsertStr, versionPlaceholder, versionExpression, -1),
+		recoveryWindow:    opts.DeleteRecoveryWindow,
+		writeAttempts:     opts.WriteAttempts,
+		timeouts:          opts.Timeouts.withDefaults(),
+		compressOld:       opts.CompressOldVersions,
+		blobFormat:        opts.BlobFormat,
+		stop:              make(chan struct{}),
+	}
+
+	ps.listener = ps.listenForUnlocks(databaseUrl)
+	if ps.recoveryWindow > 0 {
+		go ps.sweepDeletedStates()
+	}
+
+	if opts.MaxLockHold > 0 {
+		go newLockHoldSweeper(ps, opts.MaxLockHold, opts.MaxLockHoldWebhook, opts.ReleaseOverdueLocks).run(ps.stop)
+	}
+
+	return ps, err
+}
+
+// sweepDeletedStates purges soft-deleted states past the recovery window until the store is closed
+func (ps *postgresStore) sweepDeletedStates() {
+	ticker := time.NewTicker(deleteSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.stop:
+			return
+		case <-ticker.C:
+			purged, err := ps.purgeDeletedStates()
+			if err != nil {
+				logrus.Errorf("Can't purge deleted states: %s", err.Error())
+			} else if purged > 0 {
+				logrus.Infof("Purged %d rows of deleted states", purged)
+			}
+		}
+	}
+}
+
+// purgeDeletedStates removes all versions of states whose latest version
+// is a delete older than the recovery window
+func (ps *postgresStore) purgeDeletedStates() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
+	defer cancel()
+	var purged int64
+	for _, table := range ps.tables {
+		res, err := ps.db.ExecContext(ctx, onTable(purgeDeletedStr, table), ps.recoveryWindow.Seconds())
+		if err != nil {
+			return purged, err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+
+		purged += affected
+	}
+
+	return purged, nil
+}
+
+// listenForUnlocks subscribes to unlock notifications
+// if that doesn't work lock waiters fall back to polling
+func (ps *postgresStore) listenForUnlocks(databaseUrl string) *pq.Listener {
+	listener := pq.NewListener(databaseUrl, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logrus.Warnf("Unlock listener event %d: %s", event, err.Error())
+		}
+	})
+
+	err := listener.Listen(unlockChannel)
+	if err != nil {
+		logrus.Warnf("Can't listen for unlocks, falling back to polling: %s", err.Error())
+		listener.Close()
+		return nil
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				// the listener reconnected and we might have missed notifications
+				ps.notifier.notifyAll()
+				continue
+			}
+
+			payload := &unlockPayload{}
+			err := json.Unmarshal([]byte(n.Extra), payload)
+			if err != nil {
+				logrus.Errorf("Can't parse unlock notification [%s]: %s", n.Extra, err.Error())
+				continue
+			}
+
+			ps.notifier.notify(stateKey{payload.StateID, payload.Name})
+		}
+	}()
+
+	return listener
+}
+
+// notifyUnlock announces the release of a lock to all tf-locker instances
+// postgres only delivers the notification when the transaction commits
+func notifyUnlock(ctx context.Context, txn *sql.Tx, stateID string, name string) error {
+	payload, err := json.Marshal(&unlockPayload{StateID: stateID, Name: name})
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, unlockNotifyStr, unlockChannel, string(payload))
+	return err
+}
+
+func connectToPostgres(databaseUrl string, tables []string, migrate bool) (*sql.DB, error) {
+	db, err := sql.Open("postgres", databaseUrl)
+	if err != nil {
+		logrus.Panicf("%s", err.Error())
+	}
+
+	if migrate {
+		err = ensureTableExists(db, tables)
+		if err != nil {
+			logrus.Panicf("%s", err.Error())
+		}
+	}
+
+	err = verifySchemaVersion(db)
+	if err == nil {
+		err = verifyColumns(db, tables)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// verifyColumns makes sure every states table has the columns queries read
+// with the types they are scanned into
+// tables that were altered by hand fail here instead of producing bad reads
+func verifyColumns(db *sql.DB, tables []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, table := range tables {
+		rows, err := db.QueryContext(ctx, columnsSelectStr, table)
+		if err != nil {
+			return err
+		}
+
+		columns := make(map[string]string)
+		for rows.Next() {
+			var column, dataType string
+			err = rows.Scan(&column, &dataType)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			columns[column] = dataType
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for column, expectedType := range expectedColumns {
+			dataType, ok := columns[column]
+			if !ok {
+				return fmt.Errorf("%w: table %s has no column %s", ErrSchemaNotReady, table, column)
+			} else if dataType != expectedType {
+				return fmt.Errorf("%w: column %s of table %s is %s but needs to be %s", ErrSchemaNotReady, column, table, dataType, expectedType)
+			}
+		}
+
+		for column := range columns {
+			if _, ok := expectedColumns[column]; !ok {
+				logrus.Warnf("Table %s has column %s that tf-locker doesn't know", table, column)
+			}
+		}
+	}
+
+	return nil
+}
+
+// verifySchemaVersion refuses schemas older than SchemaVersion
+// queries against them would fail in confusing ways or worse
+// newer schemas are fine, migrations only ever add to the schema
+func verifySchemaVersion(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var version int
+	err := db.QueryRowContext(ctx, schemaVersionSelectStr).Scan(&version)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUndefinedTable {
+		version = 0
+	} else if err != nil {
+		return err
+	}
+
+	if version < SchemaVersion {
+		return fmt.Errorf("%w: database schema is at version %d but this tf-locker needs version %d, migrate it with 'tf-locker --init-db'", ErrSchemaNotReady, version, SchemaVersion)
+	} else if version > SchemaVersion {
+		logrus.Warnf("Database schema is at version %d, newer than version %d this tf-locker knows", version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// InitSchema creates the tables and applies all migrations without starting a store
+// that way the schema can be set up by a one-shot job with more privileges than the server
+func InitSchema(databaseUrl string, shards int) error {
+	db, err := sql.Open("postgres", databaseUrl)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+	return ensureTableExists(db, shardTables(shards))
+}
+
+func ensureTableExists(db *sql.DB, tables []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, table := range tables {
+		_, err := db.ExecContext(ctx, onTable(tableCreationQuery, table))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, migration := range schemaMigrations {
+		if !strings.Contains(migration, statesTable) {
+			_, err := db.ExecContext(ctx, migration)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, table := range tables {
+			_, err := db.ExecContext(ctx, onTable(migration, table))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := db.ExecContext(ctx, schemaVersionInsertStr, SchemaVersion)
+	return err
+}
+
+// forState fills in the table placeholder of a query with the shard of a state
+func (ps *postgresStore) forState(query string, stateID string) string {
+	return onTable(query, shardFor(ps.tables, stateID))
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// isLocked tells whether a lock column holds a lock and which one
+// NULL, an empty string and blanks all mean the state isn't locked
+// the ID of the LockInfo is what lock ids presented by clients are compared to
+func isLocked(lockInfo sql.NullString) (bool, *LockInfo) {
+	if !lockInfo.Valid || strings.TrimSpace(lockInfo.String) == "" {
+		return false, nil
+	}
+
+	li := parseLockInfo(lockInfo.String)
+	li.ID = lockIDFromLockInfo(lockInfo.String)
+	return true, li
+}
+
+// translateError turns postgres errors of inserts that are part of the protocol into typed errors
+// a unique violation on the primary key means a concurrent writer took our version
+// and so does an insert that did nothing on conflict and returned no row
+func translateError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+		return ErrVersionConflict
+	} else if err == sql.ErrNoRows {
+		return ErrVersionConflict
+	}
+
+	return err
+}
+
+// withTx runs f in a transaction that is committed if f succeeds and rolled back otherwise
+// all statements in f should run with ctx, its deadline bounds the entire transaction
+func (ps *postgresStore) withTx(ctx context.Context, f func(*sql.Tx) error) error {
+	txn, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer txn.Rollback()
+	err = f(txn)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// UpsertState writes a new version of a state and returns its version
+// and whether the write created the state, i.e. it had no data before
+// a non-empty idempotencyKey makes retries of the same write return the version
+// of the first successful attempt instead of writing again
+func (ps *postgresStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return ps.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, false)
+}
+
+// ReplaceState writes a new version of a state if the latest version has the md5 expectedMD5
+// otherwise it fails with ErrPreconditionFailed
+func (ps *postgresStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	return ps.writeState(stateID, name, lockID, data, false, 0, expectedMD5, idempotencyKey, false, false)
+}
+
+// CommitAndUnlock writes a new version of a state and releases the lock held by lockID
+// in the same transaction
+func (ps *postgresStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	return ps.writeState(stateID, name, lockID, data, false, 0, "", idempotencyKey, false, true)
+}
+
+// writeState inserts a new version of a state
+// if the state is locked, lockID needs to match the lock unless force is set
+// a forced write without lock id breaks the lock
+// if expectedVersion isn't zero, the latest version needs to be expectedVersion
+// if expectedMD5 isn't empty, the latest version needs to have that md5
+// deleted marks the new version as a soft-delete
+// unlock releases the lock held by lockID with the new version
+// when a concurrent writer took the version, the write starts over on top of
+// the version that writer created until it ran out of attempts
+func (ps *postgresStore) writeState(stateID string, name string, lockID string, data []byte, force bool, expectedVersion int, expectedMD5 string, idempotencyKey string, deleted bool, unlock bool) (WriteResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := ps.tryWriteState(stateID, name, lockID, data, force, expectedVersion, expectedMD5, idempotencyKey, deleted, unlock)
+		if !errors.Is(err, ErrVersionConflict) || attempt >= ps.writeAttempts {
+			return result, err
+		}
+
+		logrus.Infof("Version of [%s] [%s] was taken by a concurrent writer, retrying (attempt %d of %d)", name, stateID, attempt, ps.writeAttempts)
+	}
+}
+
+// tryWriteState is a single attempt of writeState in one transaction
+func (ps *postgresStore) tryWriteState(stateID string, name string, lockID string, data []byte, force bool, expectedVersion int, expectedMD5 string, idempotencyKey string, deleted bool, unlock bool) (WriteResult, error) {
+	stored, err := encodeBlob(ps.blobFormat, data)
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Write)
+	defer cancel()
+	var version int
+	var serial int64
+	var created bool
+	err = ps.withTx(ctx, func(txn *sql.Tx) error {
+		var queriedLockInfo sql.NullString
+		var lockedBy sql.NullString
+		var lockedAt sql.NullTime
+		// created tells whether the state has no data yet, then this write creates it
+		start := time.Now()
+		err := txn.QueryRowContext(ctx, ps.forState(writeSelectForUpdateStr, stateID), stateID, name).Scan(&version, &queriedLockInfo, &lockedBy, &lockedAt, &created)
+		observeQuery(querySelectForUpdate, start)
+		if err == sql.ErrNoRows {
+			// there's no row to lock yet, whoever created it while we waited wins
+			err = lockCreation(ctx, txn, stateID, name)
+			if err != nil {
+				return err
+			}
+
+			err = txn.QueryRowContext(ctx, ps.forState(writeSelectForUpdateStr, stateID), stateID, name).Scan(&version, &queriedLockInfo, &lockedBy, &lockedAt, &created)
+		}
+		if err == sql.ErrNoRows {
+			version = 0
+			created = true
+		} else if err != nil {
+			return err
+		}
+
+		if idempotencyKey != "" {
+			// the row lock above serializes writers of this state
+			// a retry that raced the original write sees its key here
+			var previousVersion int
+			var previousSerial int64
+			err = txn.QueryRowContext(ctx, idempotencySelectStr, idempotencyKey, stateID, name, ps.idempotencyKeyTTL.Seconds()).Scan(&previousVersion, &previousSerial)
+			if err == nil {
+				logrus.Infof("Write [%s] to [%s] [%s] was done already: version %d", idempotencyKey, name, stateID, previousVersion)
+				version = previousVersion
+				serial = previousSerial
+				created = false
+				return nil
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+		}
+
+		// writes to states nobody locked go through
+		locked, held := isLocked(queriedLockInfo)
+		if locked && held.ID != lockID {
+			if !force {
+				logrus.Infof("Lock ids don't line up: want [%s] have [%s]", held.ID, lockID)
+				return lockedError(queriedLockInfo.String)
+			}
+
+			logrus.Warnf("Forcefully writing [%s] [%s] locked by [%s]", name, stateID, queriedLockInfo.String)
+		}
+
+		if unlock && (lockID == "" || !locked) {
+			return fmt.Errorf("Can't unlock [%s] [%s] after the write: %w", name, stateID, ErrNotLocked)
+		}
+
+		if expectedVersion != 0 && version != expectedVersion {
+			logrus.Infof("Version of [%s] [%s] is %d but %d was expected", name, stateID, version, expectedVersion)
+			return ErrPreconditionFailed
+		}
+
+		if expectedMD5 != "" {
+			// the row lock above keeps the latest version from changing until we're done
+			var blob []byte
+			err = txn.QueryRowContext(ctx, ps.forState(versionBlobSelectStr, stateID), stateID, name, version).Scan(&blob)
+			if err == sql.ErrNoRows {
+				logrus.Infof("[%s] [%s] doesn't exist but md5 %s was expected", name, stateID, expectedMD5)
+				return ErrPreconditionFailed
+			} else if err != nil {
+				return err
+			}
+
+			blob, err = decodeBlob(blob)
+			if err != nil {
+				return err
+			}
+
+			if blobMD5(blob) != expectedMD5 {
+				logrus.Infof("md5 of [%s] [%s] is %s but %s was expected", name, stateID, blobMD5(blob), expectedMD5)
+				return ErrPreconditionFailed
+			}
+		}
+
+		// the version strategy might pick a different version than the next one
+		// the insert tells us which one it was
+		insert := ps.forState(ps.upsertInsertStr, stateID)
+		start = time.Now()
+		if lockID == "" {
+			err = txn.QueryRowContext(ctx, insert, stateID, name, version+1, nil, stored, nil, deleted, nil, blobMD5(data)).Scan(&version)
+		} else {
+			// be sure to put the entire lock info back into the DB
+			// not only the lock id
+			err = txn.QueryRowContext(ctx, insert, stateID, name, version+1, queriedLockInfo.String, stored, lockedBy, deleted, lockedAt, blobMD5(data)).Scan(&version)
+		}
+		observeQuery(queryInsert, start)
+		if err != nil {
+			return translateError(err)
+		}
+
+		// a write that doesn't commit gives its serial back
+		err = txn.QueryRowContext(ctx, serialUpsertStr, stateID, name).Scan(&serial)
+		if err != nil {
+			return err
+		}
+
+		if lockID == "" && locked {
+			// a forced write broke the lock
+			err = notifyUnlock(ctx, txn, stateID, name)
+			if err != nil {
+				return err
+			}
+		} else if unlock {
+			err = ps.clearLock(ctx, txn, stateID, name, lockIDFromLockInfo(lockID), version)
+			if err != nil {
+				return err
+			}
+		}
+
+		if idempotencyKey != "" {
+			_, err = txn.ExecContext(ctx, idempotencyInsertStr, idempotencyKey, stateID, name, version, serial)
+			if err != nil {
+				return translateError(err)
+			}
+
+			// keys past their ttl are cleaned up by the writes that bring in new ones
+			_, err = txn.ExecContext(ctx, idempotencyExpireStr, ps.idempotencyKeyTTL.Seconds())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	return WriteResult{Version: version, Serial: serial, Created: created}, nil
+}
+
+func (ps *postgresStore) GetState(stateID string, name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Get)
+	defer cancel()
+	var bites []byte
+	var version int
+	var deleted bool
+	start := time.Now()
+	err := ps.db.QueryRowContext(ctx, ps.forState(getSelectStr, stateID), stateID, name).Scan(&version, &bites, &deleted)
+	observeQuery(queryGetSelect, start)
+	if err == sql.ErrNoRows {
+		return make([]byte, 0), nil
+	} else if err != nil {
+		return nil, err
+	} else if deleted {
+		return nil, fmt.Errorf("State [%s] [%s] has been deleted: %w", name, stateID, ErrNotFound)
+	}
+
+	return decodeBlob(bites)
+}
+
+// GetStateAndLock returns the latest blob of a state and the lock held on it
+// the lock info is nil if the state isn't locked
+// both come out of the same row so they belong together
+func (ps *postgresStore) GetStateAndLock(stateID string, name string) ([]byte, *LockInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Get)
+	defer cancel()
+	var bites []byte
+	var lockInfo sql.NullString
+	var deleted bool
+	start := time.Now()
+	err := ps.db.QueryRowContext(ctx, ps.forState(getAndLockSelectStr, stateID), stateID, name).Scan(&bites, &lockInfo, &deleted)
+	observeQuery(queryGetSelect, start)
+	if err == sql.ErrNoRows {
+		return make([]byte, 0), nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	} else if deleted {
+		return nil, nil, fmt.Errorf("State [%s] [%s] has been deleted: %w", name, stateID, ErrNotFound)
+	}
+
+	bites, err = decodeBlob(bites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return bites, storedLockInfo(lockInfo.String), nil
+}
+
+// GetLockInfo returns the lock held on a state
+// it returns ErrNotLocked if the state isn't locked or doesn't exist
+func (ps *postgresStore) GetLockInfo(stateID string, name string) (*LockInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Lock)
+	defer cancel()
+	var lockInfo sql.NullString
+	start := time.Now()
+	err := ps.db.QueryRowContext(ctx, ps.forState(lockInfoSelectStr, stateID), stateID, name).Scan(&lockInfo)
+	observeQuery(queryGetSelect, start)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotLocked
+	} else if err != nil {
+		return nil, err
+	}
+
+	li := storedLockInfo(lockInfo.String)
+	if li == nil {
+		return nil, ErrNotLocked
+	}
+
+	return li, nil
+}
+
+// VerifyLock checks that lockID holds the lock on a state
+// it returns ErrNotLocked if the state isn't locked and ErrLockMismatch if somebody else holds the lock
+func (ps *postgresStore) VerifyLock(stateID string, name string, lockID string) error {
+	li, err := ps.GetLockInfo(stateID, name)
+	if err != nil {
+		return err
+	}
+
+	return verifyLockHolder(li, lockID)
+}
+
+// GetStates returns the latest versions of many states with one query per shard
+// states that don't exist or have been deleted are left out
+func (ps *postgresStore) GetStates(refs []StateRef) ([]*VersionedState, error) {
+	states := make([]*VersionedState, 0, len(refs))
+	if len(refs) == 0 {
+		return states, nil
+	}
+
+	// one query per shard that holds any of the states
+	refsByTable := make(map[string][]StateRef)
+	for _, ref := range refs {
+		table := shardFor(ps.tables, ref.StateID)
+		refsByTable[table] = append(refsByTable[table], ref)
+	}
+
+	for _, table := range ps.tables {
+		if len(refsByTable[table]) == 0 {
+			continue
+		}
+
+		var err error
+		states, err = ps.getStatesOn(table, refsByTable[table], states)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return states, nil
+}
+
+// getStatesOn appends the latest versions of states that live in the same table
+func (ps *postgresStore) getStatesOn(table string, refs []StateRef, states []*VersionedState) ([]*VersionedState, error) {
+	placeholders := make([]string, len(refs))
+	args := make([]interface{}, 0, 2*len(refs))
+	for idx, ref := range refs {
+		placeholders[idx] = fmt.Sprintf("($%d::uuid, $%d)", 2*idx+1, 2*idx+2)
+		args = append(args, ref.StateID, ref.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Get)
+	defer cancel()
+	rows, err := ps.db.QueryContext(ctx, fmt.Sprintf(onTable(batchSelectStr, table), strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		state := &VersionedState{}
+		err = rows.Scan(&state.StateID, &state.Name, &state.Version, &state.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		state.Data, err = decodeBlob(state.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(state.Data) > 0 {
+			states = append(states, state)
+		}
+	}
+
+	return states, rows.Err()
+}
+
+// StateExists reports whether the latest version of a state has any data
+// deleted states and states that have only been locked so far don't count
+func (ps *postgresStore) StateExists(stateID string, name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Get)
+	defer cancel()
+	var exists bool
+	err := ps.db.QueryRowContext(ctx, ps.forState(existsSelectStr, stateID), stateID, name).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// StateSize returns how many bytes the latest version of a state takes up in the database
+// the blob isn't read, deleted states and states that have only been locked so far are zero
+func (ps *postgresStore) StateSize(stateID string, name string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Get)
+	defer cancel()
+	var size int
+	err := ps.db.QueryRowContext(ctx, ps.forState(sizeSelectStr, stateID), stateID, name).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// DeleteState writes an empty version of a state
+// a locked state can only be deleted by the lock holder or with force
+// if expectedVersion isn't zero, the state is only deleted if it's still at that version
+func (ps *postgresStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	_, err := ps.writeState(stateID, name, lockID, make([]byte, 0), force, expectedVersion, "", "", ps.recoveryWindow > 0, false)
+	return err
+}
+
+// PurgeState removes every version of a state, there is no way to get it back
+// a locked state is only purged with force
+func (ps *postgresStore) PurgeState(stateID string, name string, force bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Write)
+	defer cancel()
+	return ps.withTx(ctx, func(txn *sql.Tx) error {
+		var queriedLockInfo sql.NullString
+		start := time.Now()
+		err := txn.QueryRowContext(ctx, ps.forState(purgeSelectForUpdateStr, stateID), stateID, name).Scan(&queriedLockInfo)
+		observeQuery(querySelectForUpdate, start)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Can't purge [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if err != nil {
+			return err
+		}
+
+		locked, _ := isLocked(queriedLockInfo)
+		if locked && !force {
+			return lockedError(queriedLockInfo.String)
+		} else if locked {
+			logrus.Warnf("Forcefully purging [%s] [%s] locked by [%s]", name, stateID, queriedLockInfo.String)
+		}
+
+		_, err = txn.ExecContext(ctx, ps.forState(purgeDeleteStr, stateID), stateID, name)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.ExecContext(ctx, purgeIdempotencyDeleteStr, stateID, name)
+		if err != nil {
+			return err
+		}
+
+		if locked {
+			return notifyUnlock(ctx, txn, stateID, name)
+		}
 
-type postgresStore struct {
-	db *sql.DB
+		return nil
+	})
 }
 
-func NewPostgresStore(databaseUrl string) (*postgresStore, error) {
-	db, err := connectToPostgres(databaseUrl)
-	if err != nil {
-		return nil, err
+// UndeleteState restores a soft-deleted state within the recovery window
+// the data of the version before the delete becomes the latest version again
+func (ps *postgresStore) UndeleteState(stateID string, name string) (int, error) {
+	if ps.recoveryWindow <= 0 {
+		return 0, fmt.Errorf("Soft-delete is turned off, can't undelete [%s] [%s]: %w", name, stateID, ErrNotFound)
 	}
 
-	return &postgresStore{
-		db: db,
-	}, err
-}
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Write)
+	defer cancel()
+	var version int
+	err := ps.withTx(ctx, func(txn *sql.Tx) error {
+		var queriedLockInfo sql.NullString
+		var deleted bool
+		var recoverable bool
+		err := txn.QueryRowContext(ctx, ps.forState(undeleteSelectForUpdateStr, stateID), stateID, name, ps.recoveryWindow.Seconds()).Scan(&version, &queriedLockInfo, &deleted, &recoverable)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if err != nil {
+			return err
+		} else if !deleted {
+			return fmt.Errorf("Can't undelete [%s] [%s]: %w", name, stateID, ErrNotDeleted)
+		} else if !recoverable {
+			return fmt.Errorf("Recovery window of [%s] [%s] has passed: %w", name, stateID, ErrNotFound)
+		} else if locked, _ := isLocked(queriedLockInfo); locked {
+			return lockedError(queriedLockInfo.String)
+		}
 
-func connectToPostgres(databaseUrl string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", databaseUrl)
-	if err != nil {
-		logrus.Panicf("%s", err.Error())
-	}
+		bites := make([]byte, 0)
+		err = txn.QueryRowContext(ctx, ps.forState(undeletePreviousSelectStr, stateID), stateID, name, version).Scan(&bites)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		bites, err = decodeBlob(bites)
+		if err != nil {
+			return fmt.Errorf("Can't decode version before the delete of [%s] [%s]: %w", name, stateID, err)
+		}
+
+		stored, err := encodeBlob(ps.blobFormat, bites)
+		if err != nil {
+			return err
+		}
 
-	err = ensureTableExists(db)
+		start := time.Now()
+		err = txn.QueryRowContext(ctx, ps.forState(ps.upsertInsertStr, stateID), stateID, name, version+1, nil, stored, nil, false, nil, blobMD5(bites)).Scan(&version)
+		observeQuery(queryInsert, start)
+		return translateError(err)
+	})
 	if err != nil {
-		logrus.Panicf("%s", err.Error())
+		return 0, err
 	}
 
-	return db, nil
+	return version, nil
 }
 
-func ensureTableExists(db *sql.DB) error {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// CopyState writes the latest blob of a state as version 1 of another state
+// neither of them may be locked and the target may not exist at all
+// source and target can live in different shards, it's all one transaction anyways
+func (ps *postgresStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Write)
 	defer cancel()
-	_, err := db.ExecContext(ctx, tableCreationQuery)
+	return ps.withTx(ctx, func(txn *sql.Tx) error {
+		var bites []byte
+		var srcLockInfo sql.NullString
+		var deleted bool
+		// the row lock keeps the source from being locked or written while we copy
+		err := txn.QueryRowContext(ctx, ps.forState(copySourceSelectForUpdateStr, srcID), srcID, srcName).Scan(&bites, &srcLockInfo, &deleted)
+		if err == sql.ErrNoRows || (err == nil && (deleted || len(bites) == 0)) {
+			return fmt.Errorf("Can't copy [%s] [%s]: %w", srcName, srcID, ErrNotFound)
+		} else if err != nil {
+			return err
+		} else if locked, _ := isLocked(srcLockInfo); locked {
+			return lockedError(srcLockInfo.String)
+		}
+
+		err = lockCreation(ctx, txn, dstID, dstName)
+		if err != nil {
+			return err
+		}
+
+		var dstLockInfo sql.NullString
+		err = txn.QueryRowContext(ctx, ps.forState(copyTargetSelectStr, dstID), dstID, dstName).Scan(&dstLockInfo)
+		if locked, _ := isLocked(dstLockInfo); err == nil && locked {
+			return lockedError(dstLockInfo.String)
+		} else if err == nil {
+			return fmt.Errorf("Can't copy to [%s] [%s]: %w", dstName, dstID, ErrAlreadyExists)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		// the copy is stored in the format new versions are written in
+		data, err := decodeBlob(bites)
+		if err != nil {
+			return err
+		}
+
+		stored, err := encodeBlob(ps.blobFormat, data)
+		if err != nil {
+			return err
+		}
+
+		// somebody creating the target concurrently makes this fail with a unique violation
+		start := time.Now()
+		_, err = txn.ExecContext(ctx, ps.forState(copyInsertStr, dstID), dstID, dstName, stored, blobMD5(data))
+		observeQuery(queryInsert, start)
+		return translateError(err)
+	})
+}
+
+// lockCreation serializes the transactions that create a state
+// a state that doesn't exist has no row to select for update
+// it's held until the transaction ends
+func lockCreation(ctx context.Context, txn *sql.Tx, stateID string, name string) error {
+	_, err := txn.ExecContext(ctx, creationLockStr, stateID, name)
 	return err
 }
 
-func (ps *postgresStore) UpsertState(stateID string, name string, lockID string, data []byte) error {
-	txn, err := ps.db.Begin()
+// LockState takes the lock on a state
+// owner is the client identity taking the lock and is kept for the admin views
+// it returns the id of the lock, that's the id the lock needs to be released with
+func (ps *postgresStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	_, err := ps.lockState(stateID, name, lockInfo, owner, false)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	defer txn.Rollback()
+	// the lock is stored as it came in, so its id is the one the client picked
+	return lockIDFromLockInfo(lockInfo), nil
+}
 
-	selectForUpdate, err := txn.Prepare(upsertSelectForUpdateStr)
-	if err != nil {
-		return err
-	}
+// LockAndGet takes the lock on a state and returns its latest blob
+// both happen in the same transaction so the blob is the one the lock protects
+func (ps *postgresStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	return ps.lockState(stateID, name, lockInfo, owner, true)
+}
 
-	defer selectForUpdate.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// lockState takes the lock and reads the blob in the same transaction if withBlob is set
+func (ps *postgresStore) lockState(stateID string, name string, lockInfo string, owner string, withBlob bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Lock)
 	defer cancel()
-	var version int
-	var queriedLockInfo sql.NullString
-	err = selectForUpdate.QueryRowContext(ctx, stateID, name).Scan(&version, &queriedLockInfo)
-	if err == sql.ErrNoRows {
-		version = 0
-	} else if err != nil {
-		return err
-	} else if !queriedLockInfo.Valid {
-		logrus.Info("Queried lock id is nil")
-	} else if queriedLockInfo.String != "" {
-		// lockInfo is only the lock ID
-		li := &LockInfo{}
-		err = json.Unmarshal([]byte(queriedLockInfo.String), li)
+	bites := make([]byte, 0)
+	err := ps.withTx(ctx, func(txn *sql.Tx) error {
+		selectForUpdate := ps.forState(upsertSelectForUpdateStr, stateID)
+		var version int
+		var queriedLockInfo sql.NullString
+		var lockedBy sql.NullString
+		var lockedAt sql.NullTime
+		start := time.Now()
+		err := txn.QueryRowContext(ctx, selectForUpdate, stateID, name).Scan(&version, &queriedLockInfo, &lockedBy, &lockedAt)
+		observeQuery(querySelectForUpdate, start)
+		if err == sql.ErrNoRows {
+			// writers creating the state take the same lock
+			// so under any version strategy nobody slips a version past ours
+			err = lockCreation(ctx, txn, stateID, name)
+			if err != nil {
+				return err
+			}
+
+			err = txn.QueryRowContext(ctx, selectForUpdate, stateID, name).Scan(&version, &queriedLockInfo, &lockedBy, &lockedAt)
+		}
+		if err == sql.ErrNoRows {
+			// the state doesn't exist yet
+			// create its first version with the lock already taken
+			// all of that happens in this one transaction
+			start = time.Now()
+			res, err := txn.ExecContext(ctx, ps.forState(lockInsertStr, stateID), stateID, name, 1, lockInfo, make([]byte, 0), nullString(owner))
+			observeQuery(queryLockInsert, start)
+			if err != nil {
+				return translateError(err)
+			}
+
+			affected, err := res.RowsAffected()
+			if err != nil {
+				return err
+			} else if affected == int64(1) {
+				// a new state doesn't have a blob yet
+				return nil
+			}
+
+			// somebody else created the state concurrently
+			// the insert waited for them to commit so their row is visible now
+			// and we go through the regular lock checks against it
+			start = time.Now()
+			err = txn.QueryRowContext(ctx, selectForUpdate, stateID, name).Scan(&version, &queriedLockInfo, &lockedBy, &lockedAt)
+			observeQuery(querySelectForUpdate, start)
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// taking a lock we hold already succeeds
+		// and counts as taking it now so that a retrying holder doesn't look overdue
+		locked, _ := isLocked(queriedLockInfo)
+		heldAlready := locked && queriedLockInfo.String == lockInfo
+		if locked && !heldAlready {
+			return lockedError(queriedLockInfo.String)
+		}
+
+		err = ps.updateLock(ctx, txn, stateID, name, lockInfo, owner, version)
 		if err != nil {
 			return err
 		}
 
-		if li.ID != lockID {
-			return fmt.Errorf("Lock ids don't line up: want [%s] have [%s]", queriedLockInfo.String, lockID)
+		if !withBlob {
+			return nil
 		}
-	}
 
-	insert, err := txn.Prepare(upsertInsertStr)
-	if err != nil {
+		var deleted bool
+		start = time.Now()
+		err = txn.QueryRowContext(ctx, ps.forState(getSelectStr, stateID), stateID, name).Scan(&version, &bites, &deleted)
+		observeQuery(queryGetSelect, start)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	version++
-	defer insert.Close()
-	ctx, cancel = context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	var res sql.Result
-	if lockID == "" {
-		res, err = insert.ExecContext(ctx, stateID, name, version, nil, data)
-	} else {
-		// be sure to put the entire lock info back into the DB
-		// not only the lock id
-		res, err = insert.ExecContext(ctx, stateID, name, version, queriedLockInfo.String, data)
-	}
+	return decodeBlob(bites)
+}
+
+// updateLock puts the lock on the given version of a state
+func (ps *postgresStore) updateLock(ctx context.Context, txn *sql.Tx, stateID string, name string, lockInfo string, owner string, version int) error {
+	start := time.Now()
+	res, err := txn.ExecContext(ctx, ps.forState(lockUpdateStr, stateID), lockInfo, nullString(owner), stateID, name, version)
+	observeQuery(queryLockUpdate, start)
 	if err != nil {
 		return err
 	}
@@ -148,219 +1304,463 @@ func (ps *postgresStore) UpsertState(stateID string, name string, lockID string,
 	if err != nil {
 		return err
 	} else if affected != int64(1) {
-		return fmt.Errorf("Insert didn't work")
-	}
-
-	err = txn.Commit()
-	if err != nil {
-		return err
+		return fmt.Errorf("locking didn't work")
 	}
 
 	return nil
 }
 
-func (ps *postgresStore) GetState(stateID string, name string) ([]byte, error) {
-	txn, err := ps.db.Begin()
+func (ps *postgresStore) UnlockState(stateID string, name string, lockID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Lock)
+	defer cancel()
+	return ps.withTx(ctx, func(txn *sql.Tx) error {
+		var version int
+		var queriedLockInfo sql.NullString
+		var lastLockID sql.NullString
+		start := time.Now()
+		err := txn.QueryRowContext(ctx, ps.forState(unlockSelectForUpdateStr, stateID), stateID, name).Scan(&version, &queriedLockInfo, &lastLockID)
+		observeQuery(querySelectForUpdate, start)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Can't unlock [%s] [%s]: %w", name, stateID, ErrNotFound)
+		} else if err != nil {
+			return err
+		}
+
+		requestedLockID := lockIDFromLockInfo(lockID)
+		locked, held := isLocked(queriedLockInfo)
+		if !locked && lastLockID.Valid && lastLockID.String == requestedLockID {
+			// the lock has been released already by the same holder
+			// this is most likely a retried unlock and we let it succeed
+			logrus.Infof("Lock [%s] on [%s] [%s] has been released already", requestedLockID, name, stateID)
+			return nil
+		} else if !locked || held.ID != requestedLockID {
+			return fmt.Errorf("Can't unlock [%s] [%s] with lock [%s]: %w", name, stateID, lockID, lockMismatchError(queriedLockInfo.String))
+		}
+
+		return ps.clearLock(ctx, txn, stateID, name, requestedLockID, version)
+	})
+}
+
+// clearLock releases the lock on the given version of a state
+// lockID is remembered so that retries of the unlock succeed
+func (ps *postgresStore) clearLock(ctx context.Context, txn *sql.Tx, stateID string, name string, lockID string, version int) error {
+	start := time.Now()
+	res, err := txn.ExecContext(ctx, ps.forState(unlockUpdateStr, stateID), lockID, stateID, name, version)
+	observeQuery(queryUnlockUpdate, start)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer txn.Rollback()
-
-	selectStmt, err := txn.Prepare(getSelectStr)
+	affected, err := res.RowsAffected()
 	if err != nil {
-		return nil, err
+		return err
+	} else if affected != int64(1) {
+		return fmt.Errorf("unlocking didn't work")
 	}
 
-	defer selectStmt.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return notifyUnlock(ctx, txn, stateID, name)
+}
+
+// ForceUnlock breaks the lock on a state and returns the lock info that was cleared
+// unless override is set, the lock is only cleared if it's held by expectedLockID
+// that way an operator can't accidentally break a different lock than the one they saw
+func (ps *postgresStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Lock)
 	defer cancel()
-	var bites []byte
-	var version int
-	err = selectStmt.QueryRowContext(ctx, stateID, name).Scan(&version, &bites)
-	if err == sql.ErrNoRows {
-		return make([]byte, 0), nil
-	} else if err != nil {
+	var li *LockInfo
+	err := ps.withTx(ctx, func(txn *sql.Tx) error {
+		var version int
+		var queriedLockInfo sql.NullString
+		var lastLockID sql.NullString
+		start := time.Now()
+		err := txn.QueryRowContext(ctx, ps.forState(unlockSelectForUpdateStr, stateID), stateID, name).Scan(&version, &queriedLockInfo, &lastLockID)
+		observeQuery(querySelectForUpdate, start)
+		if err == sql.ErrNoRows {
+			return ErrNotLocked
+		} else if err != nil {
+			return err
+		}
+
+		var locked bool
+		locked, li = isLocked(queriedLockInfo)
+		if !locked {
+			return ErrNotLocked
+		}
+
+		if !override && li.ID != lockIDFromLockInfo(expectedLockID) {
+			logrus.Warnf("Refusing to force unlock [%s] [%s]: expected lock [%s] but [%s] holds it", name, stateID, expectedLockID, li.ID)
+			return ErrLockMismatch
+		}
+
+		return ps.clearLock(ctx, txn, stateID, name, li.ID, version)
+	})
+	if err != nil && !errors.Is(err, ErrLockMismatch) {
 		return nil, err
 	}
 
-	return bites, nil
+	return li, err
 }
 
-func (ps *postgresStore) DeleteState(stateID string, name string) error {
-	return ps.UpsertState(stateID, name, "", make([]byte, 0))
+// ListLocks returns all states whose latest version is locked
+func (ps *postgresStore) ListLocks() ([]*StateLock, error) {
+	locks := make([]*StateLock, 0)
+	for _, table := range ps.tables {
+		var err error
+		locks, err = ps.listLocksOn(table, listLocksSelectStr, false, locks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locks, nil
 }
 
-func (ps *postgresStore) LockState(stateID string, name string, lockInfo string) error {
-	txn, err := ps.db.Begin()
-	if err != nil {
-		return err
+// ListOrphanedLocks returns the locked states none of whose versions have data
+// LOCK creates an empty first version which stays the only one when the apply dies
+func (ps *postgresStore) ListOrphanedLocks() ([]*StateLock, error) {
+	locks := make([]*StateLock, 0)
+	for _, table := range ps.tables {
+		var err error
+		locks, err = ps.listLocksOn(table, listOrphanedLocksSelectStr, true, locks)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	defer txn.Rollback()
+	return locks, nil
+}
 
-	selectForUpdate, err := txn.Prepare(upsertSelectForUpdateStr)
+func (ps *postgresStore) listLocksOn(table string, query string, orphaned bool, locks []*StateLock) ([]*StateLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.List)
+	defer cancel()
+	rows, err := ps.db.QueryContext(ctx, onTable(query, table))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer selectForUpdate.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	var version int
-	var queriedLockInfo sql.NullString
-	err = selectForUpdate.QueryRowContext(ctx, stateID, name).Scan(&version, &queriedLockInfo)
-	if err == sql.ErrNoRows {
-		version = 1
-
-		var insert *sql.Stmt
-		insert, err = txn.Prepare(upsertInsertStr)
+	defer rows.Close()
+	for rows.Next() {
+		var stateID string
+		var name string
+		var lockInfo string
+		var lockedBy sql.NullString
+		var lockedAt sql.NullTime
+		err = rows.Scan(&stateID, &name, &lockInfo, &lockedBy, &lockedAt)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		defer insert.Close()
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		var res sql.Result
-		res, err = insert.ExecContext(ctx, stateID, name, version, lockInfo, make([]byte, 0))
-		if err != nil {
-			return err
-		}
+		locks = append(locks, &StateLock{
+			StateID:  stateID,
+			Name:     name,
+			LockInfo: parseLockInfo(lockInfo),
+			Owner:    lockedBy.String,
+			LockedAt: lockedAt.Time,
+			Orphaned: orphaned,
+		})
+	}
 
-		var affected int64
-		affected, err = res.RowsAffected()
+	return locks, rows.Err()
+}
+
+// ListWorkspaces returns the workspaces of a configuration that have data
+func (ps *postgresStore) ListWorkspaces(name string) ([]string, error) {
+	stateNames := make([]string, 0)
+	for _, table := range ps.tables {
+		var err error
+		stateNames, err = ps.listStateNamesOn(table, listWorkspacesSelectStr, stateNames, name, escapeLike(name+WorkspaceSeparator)+"%")
 		if err != nil {
-			return err
-		} else if affected != int64(1) {
-			return fmt.Errorf("inserting didn't work")
+			return nil, err
 		}
+	}
 
-		queriedLockInfo.Valid = true
-		queriedLockInfo.String = lockInfo
+	return workspacesFromStateNames(name, stateNames), nil
+}
+
+// ListVersions describes the latest limit versions of a state, the latest first
+// one more version than asked for is read to find out whether there are more
+func (ps *postgresStore) ListVersions(stateID string, name string, limit int) ([]*StateVersion, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.List)
+	defer cancel()
+	// LIMIT NULL is no limit at all
+	var queryLimit sql.NullInt64
+	if limit > 0 {
+		queryLimit = sql.NullInt64{Int64: int64(limit) + 1, Valid: true}
+	}
 
-		err = txn.Commit()
+	rows, err := ps.db.QueryContext(ctx, ps.forState(listVersionsSelectStr, stateID), stateID, name, queryLimit)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer rows.Close()
+	versions := make([]*StateVersion, 0)
+	for rows.Next() {
+		var createdAt sql.NullTime
+		v := &StateVersion{}
+		err = rows.Scan(&v.Version, &createdAt, &v.Size, &v.MD5, &v.Deleted)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 
-		txn, err = ps.db.Begin()
-		if err != nil {
-			return err
+		if createdAt.Valid {
+			v.Created = &createdAt.Time
 		}
+		versions = append(versions, v)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, false, err
+	} else if len(versions) == 0 {
+		return nil, false, fmt.Errorf("No versions of [%s] [%s]: %w", name, stateID, ErrNotFound)
+	}
+
+	more := limit > 0 && len(versions) > limit
+	if more {
+		versions = versions[:limit]
+	}
 
-		defer txn.Rollback()
+	return versions, more, nil
+}
 
-		var selectForUpdate2 *sql.Stmt
-		selectForUpdate2, err = txn.Prepare(upsertSelectForUpdateStr)
+// ListNames returns the names starting with prefix that have data under any state id
+func (ps *postgresStore) ListNames(prefix string) ([]string, error) {
+	stateNames := make([]string, 0)
+	for _, table := range ps.tables {
+		var err error
+		stateNames, err = ps.listStateNamesOn(table, listNamesSelectStr, stateNames, escapeLike(prefix)+"%")
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
+
+	return uniqueSortedNames(stateNames), nil
+}
+
+// listStateNamesOn appends the names a query returns on a table to stateNames
+func (ps *postgresStore) listStateNamesOn(table string, query string, stateNames []string, args ...interface{}) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.List)
+	defer cancel()
+	rows, err := ps.db.QueryContext(ctx, onTable(query, table), args...)
+	if err != nil {
+		return nil, err
+	}
 
-		defer selectForUpdate2.Close()
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-		err = selectForUpdate2.QueryRowContext(ctx, stateID, name).Scan(&version, &queriedLockInfo)
+	defer rows.Close()
+	for rows.Next() {
+		var stateName string
+		err = rows.Scan(&stateName)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else if err != nil {
-		return err
+
+		stateNames = append(stateNames, stateName)
 	}
 
-	if queriedLockInfo.Valid && queriedLockInfo.String == lockInfo {
+	return stateNames, rows.Err()
+}
+
+// WaitForUnlock blocks until the lock on a state was released or maxWait passed
+// it doesn't take the lock, callers need to try LockState again
+func (ps *postgresStore) WaitForUnlock(stateID string, name string, maxWait time.Duration) error {
+	if ps.listener == nil {
+		if maxWait > lockPollInterval {
+			maxWait = lockPollInterval
+		}
+
+		time.Sleep(maxWait)
 		return nil
-	} else if queriedLockInfo.String != "" {
-		return ErrAlreadyLocked
 	}
 
-	update, err := txn.Prepare(lockUpdateStr)
-	if err != nil {
-		return err
+	if maxWait > lockListenInterval {
+		maxWait = lockListenInterval
+	}
+
+	ps.notifier.wait(stateKey{stateID, name}, maxWait)
+	return nil
+}
+
+// Compact removes all but the latest retention versions of every state
+// and compresses the ones that are kept but the latest if CompressOldVersions is on
+// vacuum asks postgres to reclaim the space right away
+func (ps *postgresStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	if retention < 1 {
+		return nil, fmt.Errorf("Retention needs to keep at least one version but is %d", retention)
 	}
 
-	defer update.Close()
-	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceTimeout)
 	defer cancel()
-	var res sql.Result
-	res, err = update.ExecContext(ctx, lockInfo, stateID, name, version)
+	removed := make(map[stateKey]int)
+	compressed := make(map[stateKey]int)
+	err := ps.withTx(ctx, func(txn *sql.Tx) error {
+		for _, table := range ps.tables {
+			rows, err := txn.QueryContext(ctx, onTable(compactDeleteStr, table), retention)
+			if err != nil {
+				return err
+			}
+
+			for rows.Next() {
+				key := stateKey{}
+				err = rows.Scan(&key.stateID, &key.name)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+
+				removed[key]++
+			}
+
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return err
+			}
+
+			if ps.compressOld {
+				err = compressOldVersions(ctx, txn, table, compressed)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return err
-	} else if affected != int64(1) {
-		return fmt.Errorf("locking didn't work")
+	if vacuum {
+		// VACUUM can't run inside a transaction
+		for _, table := range ps.tables {
+			_, err = ps.db.ExecContext(ctx, onTable(vacuumStr, table))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	err = txn.Commit()
-	if err != nil {
-		return err
+	results := make([]*CompactionResult, 0, len(removed))
+	for key, count := range removed {
+		results = append(results, &CompactionResult{
+			StateID:            key.stateID,
+			Name:               key.name,
+			RowsRemoved:        count,
+			VersionsCompressed: compressed[key],
+		})
 	}
 
-	return nil
-}
+	for key, count := range compressed {
+		if _, ok := removed[key]; ok {
+			continue
+		}
 
-func (ps *postgresStore) UnlockState(stateID string, name string, lockID string) error {
-	txn, err := ps.db.Begin()
-	if err != nil {
-		return err
+		results = append(results, &CompactionResult{
+			StateID:            key.stateID,
+			Name:               key.name,
+			VersionsCompressed: count,
+		})
 	}
 
-	defer txn.Rollback()
+	return results, nil
+}
+
+type versionKey struct {
+	stateKey
+	version int
+}
 
-	selectForUpdate, err := txn.Prepare(upsertSelectForUpdateStr)
+// compressOldVersions gzips the blobs of all versions of a table but the latest one of each state
+// blobs are compressed one at a time so that a large history doesn't have to fit into memory
+// versions keep the md5 of their uncompressed blob
+// blobs that start with a header byte up to maxBlobHeader are compressed already
+func compressOldVersions(ctx context.Context, txn *sql.Tx, table string, compressed map[stateKey]int) error {
+	rows, err := txn.QueryContext(ctx, onTable(compressSelectStr, table))
 	if err != nil {
 		return err
 	}
 
-	defer selectForUpdate.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	var version int
-	var queriedLockInfo sql.NullString
-	err = selectForUpdate.QueryRowContext(ctx, stateID, name).Scan(&version, &queriedLockInfo)
-	if err == sql.ErrNoRows {
-		version = 0
-	} else if err != nil {
-		return err
-	}
+	var keys []versionKey
+	for rows.Next() {
+		key := versionKey{}
+		err = rows.Scan(&key.stateID, &key.name, &key.version)
+		if err != nil {
+			rows.Close()
+			return err
+		}
 
-	if !queriedLockInfo.Valid || queriedLockInfo.String != lockID {
-		return fmt.Errorf("Can't unlock [%s] [%s] because somebody else holds the lock: %s my lockinfo is: %s", name, stateID, queriedLockInfo.String, lockID)
+		keys = append(keys, key)
 	}
 
-	update, err := txn.Prepare(lockUpdateStr)
-	if err != nil {
+	rows.Close()
+	if err = rows.Err(); err != nil {
 		return err
 	}
 
-	defer update.Close()
-	var res sql.Result
-	ctx, cancel = context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	res, err = update.ExecContext(ctx, nil, stateID, name, version)
-	if err != nil {
-		return err
+	for _, key := range keys {
+		var blob []byte
+		err = txn.QueryRowContext(ctx, onTable(compressBlobSelectStr, table), key.stateID, key.name, key.version).Scan(&blob)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// versions that aren't gzipped yet are plain
+		data, err := decodeBlob(blob)
+		if err != nil {
+			return err
+		}
+
+		packed, err := encodeBlob(BlobFormatGzip, data)
+		if err != nil {
+			return err
+		}
+
+		_, err = txn.ExecContext(ctx, onTable(compressUpdateStr, table), packed, blobMD5(data), key.stateID, key.name, key.version)
+		if err != nil {
+			return err
+		}
+
+		compressed[key.stateKey]++
 	}
 
-	affected, err := res.RowsAffected()
+	return nil
+}
+
+// CheckHealth verifies that postgres is reachable and all states tables can be read
+// it returns ErrSchemaNotReady if the database is up but a table is missing or unreadable
+func (ps *postgresStore) CheckHealth() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Default)
+	defer cancel()
+	err := ps.db.PingContext(ctx)
 	if err != nil {
 		return err
-	} else if affected != int64(1) {
-		return fmt.Errorf("locking didn't work")
 	}
 
-	err = txn.Commit()
-	if err != nil {
-		return err
+	for _, table := range ps.tables {
+		var one int
+		err = ps.db.QueryRowContext(ctx, onTable(schemaCheckStr, table)).Scan(&one)
+		if err != nil && err != sql.ErrNoRows {
+			logrus.Errorf("Schema check of [%s] failed: %s", table, err.Error())
+			return ErrSchemaNotReady
+		}
 	}
 
 	return nil
 }
 
+// Ping only checks that postgres answers, the schema isn't looked at
+func (ps *postgresStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ps.timeouts.Default)
+	defer cancel()
+	return ps.db.PingContext(ctx)
+}
+
 func (ps *postgresStore) Close() {
+	close(ps.stop)
+	if ps.listener != nil {
+		ps.listener.Close()
+	}
+
 	ps.db.Close()
 }
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// the benchmarks run against the database in TF_LOCKER_TEST_DATABASE_URL
+// go test -run XXX -bench . ./backend
+// they report allocations next to ns/op for before and after numbers
+
+// benchState is about the size of a state with a handful of resources
+var benchState = bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 200)
+
+func BenchmarkUpsertState(b *testing.B) {
+	ps := testPostgresStore(b, PostgresOptions{})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "bench", true)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ps.UpsertState(stateID, "bench", "", benchState, "")
+		if err != nil {
+			b.Fatalf("Write failed: %s", err.Error())
+		}
+	}
+}
+
+func BenchmarkGetState(b *testing.B) {
+	ps := testPostgresStore(b, PostgresOptions{})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "bench", true)
+	_, err := ps.UpsertState(stateID, "bench", "", benchState, "")
+	if err != nil {
+		b.Fatalf("Write failed: %s", err.Error())
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ps.GetState(stateID, "bench")
+		if err != nil {
+			b.Fatalf("Read failed: %s", err.Error())
+		}
+	}
+}
+
+func BenchmarkLockUnlock(b *testing.B) {
+	ps := testPostgresStore(b, PostgresOptions{})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "bench", true)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lockID := fmt.Sprintf("bench-%d", i)
+		_, err := ps.LockState(stateID, "bench", lockID, "bench")
+		if err != nil {
+			b.Fatalf("Lock failed: %s", err.Error())
+		}
+
+		err = ps.UnlockState(stateID, "bench", lockID)
+		if err != nil {
+			b.Fatalf("Unlock failed: %s", err.Error())
+		}
+	}
+}
+
+// BenchmarkLockContention has every goroutine fight over the lock of one state
+// granted/s is the throughput of lock holders, refused locks count as ops too
+func BenchmarkLockContention(b *testing.B) {
+	ps := testPostgresStore(b, PostgresOptions{})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "bench", true)
+
+	var granted int64
+	var ids int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lockID := fmt.Sprintf("bench-%d", atomic.AddInt64(&ids, 1))
+			_, err := ps.LockState(stateID, "bench", lockID, "bench")
+			if errors.Is(err, ErrAlreadyLocked) {
+				continue
+			} else if err != nil {
+				b.Errorf("Lock failed: %s", err.Error())
+				return
+			}
+
+			atomic.AddInt64(&granted, 1)
+			err = ps.UnlockState(stateID, "bench", lockID)
+			if err != nil {
+				b.Errorf("Unlock failed: %s", err.Error())
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(granted)/time.Since(start).Seconds(), "granted/s")
+}
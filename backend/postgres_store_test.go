@@ -0,0 +1,321 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// tests that need a database run against this one
+// they are skipped when it isn't set, they create and purge their own states
+const testDatabaseURLEnv = "TF_LOCKER_TEST_DATABASE_URL"
+
+func testPostgresStore(tb testing.TB, opts PostgresOptions) *postgresStore {
+	databaseURL := os.Getenv(testDatabaseURLEnv)
+	if databaseURL == "" {
+		tb.Skipf("%s isn't set", testDatabaseURLEnv)
+	}
+
+	ps, err := NewPostgresStore(databaseURL, opts)
+	if err != nil {
+		tb.Fatalf("Can't connect to %s: %s", RedactDSN(databaseURL), err.Error())
+	}
+
+	return ps
+}
+
+func TestTranslateError(t *testing.T) {
+	undefinedTable := &pq.Error{Code: pqUndefinedTable}
+	other := errors.New("connection reset")
+	cases := []struct {
+		err        error
+		translated error
+	}{
+		{&pq.Error{Code: pqUniqueViolation}, ErrVersionConflict},
+		{sql.ErrNoRows, ErrVersionConflict},
+		{undefinedTable, undefinedTable},
+		{other, other},
+		{nil, nil},
+	}
+
+	for _, c := range cases {
+		translated := translateError(c.err)
+		if translated != c.translated {
+			t.Errorf("translateError(%v) = %v, want %v", c.err, translated, c.translated)
+		}
+	}
+}
+
+func TestIsLocked(t *testing.T) {
+	lockInfo := `{"ID":"21372f90-cb29-bbdf-0fea-75240e6d00bc","Operation":"OperationTypeApply","Who":"alice"}`
+	cases := []struct {
+		lockInfo sql.NullString
+		locked   bool
+		id       string
+	}{
+		{sql.NullString{}, false, ""},
+		{sql.NullString{String: "", Valid: true}, false, ""},
+		{sql.NullString{String: "  \n", Valid: true}, false, ""},
+		// a NULL column doesn't hold a lock whatever the string says
+		{sql.NullString{String: lockInfo, Valid: false}, false, ""},
+		{sql.NullString{String: lockInfo, Valid: true}, true, "21372f90-cb29-bbdf-0fea-75240e6d00bc"},
+		// a lock info that isn't json is taken as the lock id itself
+		{sql.NullString{String: "21372f90-cb29-bbdf-0fea-75240e6d00bc", Valid: true}, true, "21372f90-cb29-bbdf-0fea-75240e6d00bc"},
+	}
+
+	for _, c := range cases {
+		locked, li := isLocked(c.lockInfo)
+		if locked != c.locked {
+			t.Errorf("isLocked(%+v) = %t, want %t", c.lockInfo, locked, c.locked)
+		} else if !locked && li != nil {
+			t.Errorf("isLocked(%+v) isn't locked but has lock info %+v", c.lockInfo, li)
+		} else if locked && (li == nil || li.ID != c.id) {
+			t.Errorf("isLocked(%+v) has lock info %+v, want lock id %s", c.lockInfo, li, c.id)
+		}
+	}
+}
+
+// a version strategy that hands out the same version over and over
+// makes every write after the first one collide
+func TestWriteVersionCollision(t *testing.T) {
+	versionExpressions["repeat"] = "1"
+	defer delete(versionExpressions, "repeat")
+
+	ps := testPostgresStore(t, PostgresOptions{VersionStrategy: "repeat", WriteAttempts: 3})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "collision", true)
+
+	result, err := ps.UpsertState(stateID, "collision", "", []byte("first"), "")
+	if err != nil {
+		t.Fatalf("First write failed: %s", err.Error())
+	} else if result.Version != 1 {
+		t.Fatalf("First write got version %d, want 1", result.Version)
+	}
+
+	// every attempt takes version 1 again, the retries run out
+	_, err = ps.UpsertState(stateID, "collision", "", []byte("second"), "")
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Colliding write failed with %v, want %v", err, ErrVersionConflict)
+	}
+
+	data, err := ps.GetState(stateID, "collision")
+	if err != nil {
+		t.Fatalf("Can't read the state back: %s", err.Error())
+	} else if string(data) != "first" {
+		t.Fatalf("State is %s after the collision, want first", string(data))
+	}
+}
+
+// writers that collide are retried by the store
+// every round of collisions has a winner, so with no more writers than attempts
+// every write goes through with a version of its own
+func TestConcurrentWriters(t *testing.T) {
+	ps := testPostgresStore(t, PostgresOptions{})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "writers", true)
+
+	const writers = DefaultWriteAttempts
+	for round := 0; round < 10; round++ {
+		versions := make(chan int, writers)
+		errs := make(chan error, writers)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				<-start
+				data := []byte(fmt.Sprintf(`{"round":%d,"writer":%d}`, round, w))
+				result, err := ps.UpsertState(stateID, "writers", "", data, "")
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				versions <- result.Version
+			}(w)
+		}
+
+		close(start)
+		wg.Wait()
+		close(versions)
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Write failed in round %d: %s", round, err.Error())
+		}
+
+		seen := make(map[int]bool)
+		for version := range versions {
+			if seen[version] {
+				t.Fatalf("Two writes got version %d in round %d", version, round)
+			}
+			seen[version] = true
+		}
+	}
+}
+
+func TestPostgresStoreRelock(t *testing.T) {
+	ps := testPostgresStore(t, PostgresOptions{})
+	defer ps.Close()
+
+	testRelock(t, ps)
+}
+
+// compaction gzips the versions before the latest one
+// reading one of them back needs to hand out the state, not the gzip
+func TestCompressedVersionRoundTrip(t *testing.T) {
+	ps := testPostgresStore(t, PostgresOptions{CompressOldVersions: true})
+	defer ps.Close()
+
+	stateID := uuid.New().String()
+	defer ps.PurgeState(stateID, "compressed", true)
+
+	state := []byte(`{"version":4,"serial":2,"lineage":"2b6e1d2a-5a3c-4f7e-8e5b-0c1d2e3f4a5b"}`)
+	for _, data := range [][]byte{[]byte(`{"version":4,"serial":1}`), state} {
+		_, err := ps.UpsertState(stateID, "compressed", "", data, "")
+		if err != nil {
+			t.Fatalf("Write failed: %s", err.Error())
+		}
+	}
+
+	// the delete writes an empty version, the state becomes an old version
+	err := ps.DeleteState(stateID, "compressed", "", false, 0)
+	if err != nil {
+		t.Fatalf("Delete failed: %s", err.Error())
+	}
+
+	results, err := ps.Compact(10, false)
+	if err != nil {
+		t.Fatalf("Compaction failed: %s", err.Error())
+	}
+
+	compressed := 0
+	for _, result := range results {
+		if result.StateID == stateID && result.Name == "compressed" {
+			compressed = result.VersionsCompressed
+		}
+	}
+
+	if compressed != 2 {
+		t.Fatalf("Compaction compressed %d versions, want 2", compressed)
+	}
+
+	_, err = ps.UndeleteState(stateID, "compressed")
+	if err != nil {
+		t.Fatalf("Undelete failed: %s", err.Error())
+	}
+
+	data, err := ps.GetState(stateID, "compressed")
+	if err != nil {
+		t.Fatalf("Can't read the state back: %s", err.Error())
+	} else if string(data) != string(state) {
+		t.Fatalf("State is %q after compaction, want %q", data, state)
+	}
+
+	versions, _, err := ps.ListVersions(stateID, "compressed", 0)
+	if err != nil {
+		t.Fatalf("Can't list versions: %s", err.Error())
+	}
+
+	// the compressed version keeps the md5 of the state, so does the undeleted one
+	matching := 0
+	for _, v := range versions {
+		if v.MD5 == blobMD5(state) {
+			matching++
+		}
+	}
+
+	if matching != 2 {
+		t.Fatalf("%d versions have the md5 of the state, want 2: %+v", matching, versions)
+	}
+}
+
+// lockers racing for a state that doesn't exist yet
+// exactly one of them creates it with its lock, the others are refused with the winners lock
+// which is what the server answers with a 423
+func TestPostgresConcurrentLockOfNewState(t *testing.T) {
+	ps := testPostgresStore(t, PostgresOptions{})
+	defer ps.Close()
+
+	const lockers = 4
+	for round := 0; round < 20; round++ {
+		stateID := uuid.New().String()
+		lockIDs := make([]string, lockers)
+		lockInfos := make([]string, lockers)
+		for i := range lockIDs {
+			lockIDs[i] = uuid.New().String()
+			bites, err := json.Marshal(&LockInfo{ID: lockIDs[i], Operation: "OperationTypeApply", Who: fmt.Sprintf("locker-%d", i)})
+			if err != nil {
+				t.Fatalf("Can't serialize lock info: %s", err.Error())
+			}
+			lockInfos[i] = string(bites)
+		}
+
+		errs := make([]error, lockers)
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range lockIDs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				_, errs[i] = ps.LockState(stateID, "race", lockInfos[i], "")
+			}(i)
+		}
+
+		close(start)
+		wg.Wait()
+		ps.PurgeState(stateID, "race", true)
+
+		winner := -1
+		for i, err := range errs {
+			if err == nil && winner >= 0 {
+				t.Fatalf("Round %d: %s and %s both got the lock", round, lockIDs[winner], lockIDs[i])
+			} else if err == nil {
+				winner = i
+			}
+		}
+
+		if winner < 0 {
+			t.Fatalf("Round %d: nobody got the lock: %v", round, errs)
+		}
+
+		for i, err := range errs {
+			if i == winner {
+				continue
+			}
+
+			le := &LockedError{}
+			if !errors.Is(err, ErrAlreadyLocked) || !errors.As(err, &le) || le.LockInfo.ID != lockIDs[winner] {
+				t.Fatalf("Round %d: losing lock failed with %v, want %v with the lock of %s", round, err, ErrAlreadyLocked, lockIDs[winner])
+			}
+		}
+	}
+}
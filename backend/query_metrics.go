@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// names of the prepared statements as they show up in the query label
+const (
+	querySelectForUpdate = "select_for_update"
+	queryInsert          = "insert"
+	queryGetSelect       = "get_select"
+	queryLockInsert      = "lock_insert"
+	queryLockUpdate      = "lock_update"
+	queryUnlockUpdate    = "unlock_update"
+)
+
+var (
+	queryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tf_locker_db_query_duration_seconds",
+		Help:    "Duration of prepared statement executions against the database by query",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(queryDurationHistogram)
+}
+
+// observeQuery records how long the execution of a statement took
+// under contention the time spent waiting for row locks is part of it
+func observeQuery(query string, start time.Time) {
+	queryDurationHistogram.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
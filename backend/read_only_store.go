@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"sync"
+)
+
+// readOnlyStore serves reads from the wrapped store
+// and refuses everything that would change a state with ErrReadOnly while it's read-only
+// writes can be switched on and off at runtime
+type readOnlyStore struct {
+	Store
+	mutex sync.RWMutex
+	// nil while writes are allowed
+	err error
+}
+
+func NewReadOnlyStore(store Store) *readOnlyStore {
+	ros := NewWritableStore(store)
+	ros.SetReadOnly("")
+	return ros
+}
+
+// NewMaintenanceStore is a read-only store whose refusals carry a message
+// that tells clients why writes are off and when to retry
+func NewMaintenanceStore(store Store, message string) *readOnlyStore {
+	ros := NewWritableStore(store)
+	ros.SetReadOnly(message)
+	return ros
+}
+
+// NewWritableStore lets everything through until SetReadOnly is called
+func NewWritableStore(store Store) *readOnlyStore {
+	return &readOnlyStore{
+		Store: store,
+	}
+}
+
+// SetReadOnly refuses writes from now on
+// a non-empty message goes into the refusals
+func (ros *readOnlyStore) SetReadOnly(message string) {
+	err := ErrReadOnly
+	if message != "" {
+		err = fmt.Errorf("%w: %s", ErrReadOnly, message)
+	}
+
+	ros.mutex.Lock()
+	defer ros.mutex.Unlock()
+	ros.err = err
+}
+
+// SetWritable lets writes through again
+func (ros *readOnlyStore) SetWritable() {
+	ros.mutex.Lock()
+	defer ros.mutex.Unlock()
+	ros.err = nil
+}
+
+func (ros *readOnlyStore) refusal() error {
+	ros.mutex.RLock()
+	defer ros.mutex.RUnlock()
+	return ros.err
+}
+
+func (ros *readOnlyStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	if err := ros.refusal(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return ros.Store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (ros *readOnlyStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	if err := ros.refusal(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return ros.Store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+}
+
+func (ros *readOnlyStore) CommitAndUnlock(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	if err := ros.refusal(); err != nil {
+		return WriteResult{}, err
+	}
+
+	return ros.Store.CommitAndUnlock(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (ros *readOnlyStore) LockState(stateID string, name string, lockInfo string, owner string) (string, error) {
+	if err := ros.refusal(); err != nil {
+		return "", err
+	}
+
+	return ros.Store.LockState(stateID, name, lockInfo, owner)
+}
+
+func (ros *readOnlyStore) LockAndGet(stateID string, name string, lockInfo string, owner string) ([]byte, error) {
+	if err := ros.refusal(); err != nil {
+		return nil, err
+	}
+
+	return ros.Store.LockAndGet(stateID, name, lockInfo, owner)
+}
+
+func (ros *readOnlyStore) UnlockState(stateID string, name string, lockID string) error {
+	if err := ros.refusal(); err != nil {
+		return err
+	}
+
+	return ros.Store.UnlockState(stateID, name, lockID)
+}
+
+func (ros *readOnlyStore) ForceUnlock(stateID string, name string, expectedLockID string, override bool) (*LockInfo, error) {
+	if err := ros.refusal(); err != nil {
+		return nil, err
+	}
+
+	return ros.Store.ForceUnlock(stateID, name, expectedLockID, override)
+}
+
+func (ros *readOnlyStore) DeleteState(stateID string, name string, lockID string, force bool, expectedVersion int) error {
+	if err := ros.refusal(); err != nil {
+		return err
+	}
+
+	return ros.Store.DeleteState(stateID, name, lockID, force, expectedVersion)
+}
+
+func (ros *readOnlyStore) UndeleteState(stateID string, name string) (int, error) {
+	if err := ros.refusal(); err != nil {
+		return 0, err
+	}
+
+	return ros.Store.UndeleteState(stateID, name)
+}
+
+func (ros *readOnlyStore) PurgeState(stateID string, name string, force bool) error {
+	if err := ros.refusal(); err != nil {
+		return err
+	}
+
+	return ros.Store.PurgeState(stateID, name, force)
+}
+
+func (ros *readOnlyStore) CopyState(srcID string, srcName string, dstID string, dstName string) error {
+	if err := ros.refusal(); err != nil {
+		return err
+	}
+
+	return ros.Store.CopyState(srcID, srcName, dstID, dstName)
+}
+
+func (ros *readOnlyStore) Compact(retention int, vacuum bool) ([]*CompactionResult, error) {
+	if err := ros.refusal(); err != nil {
+		return nil, err
+	}
+
+	return ros.Store.Compact(retention, vacuum)
+}
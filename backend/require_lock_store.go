@@ -0,0 +1,60 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+)
+
+// requireLockStore refuses writes to states that aren't locked with ErrLockRequired
+// terraform always locks before it writes, other clients have to do the same
+// whether the lock is the writers own is checked by the wrapped store
+type requireLockStore struct {
+	Store
+}
+
+func NewRequireLockStore(store Store) *requireLockStore {
+	return &requireLockStore{
+		Store: store,
+	}
+}
+
+func (rls *requireLockStore) requireLock(stateID string, name string) error {
+	_, err := rls.Store.GetLockInfo(stateID, name)
+	if errors.Is(err, ErrNotLocked) {
+		return fmt.Errorf("Can't write [%s] [%s]: %w", name, stateID, ErrLockRequired)
+	}
+
+	return err
+}
+
+func (rls *requireLockStore) UpsertState(stateID string, name string, lockID string, data []byte, idempotencyKey string) (WriteResult, error) {
+	if err := rls.requireLock(stateID, name); err != nil {
+		return WriteResult{}, err
+	}
+
+	return rls.Store.UpsertState(stateID, name, lockID, data, idempotencyKey)
+}
+
+func (rls *requireLockStore) ReplaceState(stateID string, name string, lockID string, data []byte, expectedMD5 string, idempotencyKey string) (WriteResult, error) {
+	if err := rls.requireLock(stateID, name); err != nil {
+		return WriteResult{}, err
+	}
+
+	return rls.Store.ReplaceState(stateID, name, lockID, data, expectedMD5, idempotencyKey)
+}
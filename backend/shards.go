@@ -0,0 +1,73 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Sharding spreads the states over several tables by a hash of the state id.
+// Every operation on a single state touches exactly one table, which takes
+// pressure off a single hot table and its indexes in very large deployments.
+// The price is paid by everything that looks at more than one state:
+// listing locks and workspaces, batch reads, compaction and the schema check
+// have to visit every shard one after the other, there is no single query
+// that sees all states without a union over all shard tables.
+// The shard of a state depends on the shard count, changing the count
+// of an existing deployment hides all states that were written before
+// until they have been moved to their new tables.
+
+const (
+	// queries name their table with this placeholder
+	statesTable = "{states}"
+	// the table that is used when sharding is off
+	defaultStatesTable = "states"
+)
+
+// shardTables returns the names of all tables states are stored in
+// a single shard keeps everything in the original table
+func shardTables(shards int) []string {
+	if shards <= 1 {
+		return []string{defaultStatesTable}
+	}
+
+	tables := make([]string, shards)
+	for idx := range tables {
+		tables[idx] = fmt.Sprintf("%s_%02d", defaultStatesTable, idx)
+	}
+
+	return tables
+}
+
+// shardFor picks the table of a state
+// postgres doesn't care about the case of a uuid and neither do we
+func shardFor(tables []string, stateID string) string {
+	if len(tables) == 1 {
+		return tables[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(stateID)))
+	return tables[h.Sum32()%uint32(len(tables))]
+}
+
+// onTable fills the table placeholder of a query
+func onTable(query string, table string) string {
+	return strings.Replace(query, statesTable, table, -1)
+}
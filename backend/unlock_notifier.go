@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// unlockNotifier wakes up goroutines waiting for a lock on a state to be released
+type unlockNotifier struct {
+	mutex   sync.Mutex
+	waiters map[stateKey][]chan struct{}
+}
+
+func newUnlockNotifier() *unlockNotifier {
+	return &unlockNotifier{
+		waiters: make(map[stateKey][]chan struct{}),
+	}
+}
+
+func (un *unlockNotifier) subscribe(key stateKey) chan struct{} {
+	un.mutex.Lock()
+	defer un.mutex.Unlock()
+
+	ch := make(chan struct{})
+	un.waiters[key] = append(un.waiters[key], ch)
+	return ch
+}
+
+func (un *unlockNotifier) unsubscribe(key stateKey, ch chan struct{}) {
+	un.mutex.Lock()
+	defer un.mutex.Unlock()
+
+	waiters := un.waiters[key]
+	for idx := range waiters {
+		if waiters[idx] == ch {
+			waiters = append(waiters[:idx], waiters[idx+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(un.waiters, key)
+	} else {
+		un.waiters[key] = waiters
+	}
+}
+
+// notify wakes up all waiters of a state
+func (un *unlockNotifier) notify(key stateKey) {
+	un.mutex.Lock()
+	defer un.mutex.Unlock()
+
+	for _, ch := range un.waiters[key] {
+		close(ch)
+	}
+
+	delete(un.waiters, key)
+}
+
+// notifyAll wakes up everybody
+// that's necessary when notifications might have been lost
+func (un *unlockNotifier) notifyAll() {
+	un.mutex.Lock()
+	defer un.mutex.Unlock()
+
+	for key, waiters := range un.waiters {
+		for _, ch := range waiters {
+			close(ch)
+		}
+		delete(un.waiters, key)
+	}
+}
+
+// wait blocks until the state is notified or maxWait passed
+func (un *unlockNotifier) wait(key stateKey, maxWait time.Duration) {
+	ch := un.subscribe(key)
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+	case <-timer.C:
+		un.unsubscribe(key, ch)
+	}
+}
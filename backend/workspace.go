@@ -0,0 +1,102 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultWorkspace is the workspace terraform starts out with
+// states that were stored without a workspace belong to it
+const DefaultWorkspace = "default"
+
+// WorkspaceSeparator separates the configuration name from the workspace in the name column
+// neither of them can contain it
+const WorkspaceSeparator = ":"
+
+// WorkspaceStateName is the name a workspace of a configuration is stored under
+// the default workspace is stored under the plain configuration name
+// which keeps all states written before workspaces existed addressable
+func WorkspaceStateName(name string, workspace string) string {
+	if workspace == "" || workspace == DefaultWorkspace {
+		return name
+	}
+
+	return name + WorkspaceSeparator + workspace
+}
+
+// SplitStateName is the inverse of WorkspaceStateName
+// the default workspace comes back as an empty workspace
+func SplitStateName(stateName string) (string, string) {
+	parts := strings.SplitN(stateName, WorkspaceSeparator, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// workspaceFromStateName is the inverse of WorkspaceStateName
+func workspaceFromStateName(name string, stateName string) string {
+	if stateName == name {
+		return DefaultWorkspace
+	}
+
+	return strings.TrimPrefix(stateName, name+WorkspaceSeparator)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `%`, `\%`, -1)
+	s = strings.Replace(s, `_`, `\_`, -1)
+	return s
+}
+
+// uniqueSortedNames sorts names and drops duplicates
+// names come back once per shard and state id
+func uniqueSortedNames(names []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+
+	sort.Strings(unique)
+	return unique
+}
+
+// workspacesFromStateNames turns the stored names of a configuration
+// into a sorted, duplicate free list of workspaces
+func workspacesFromStateNames(name string, stateNames []string) []string {
+	seen := make(map[string]bool)
+	workspaces := make([]string, 0)
+	for _, stateName := range stateNames {
+		workspace := workspaceFromStateName(name, stateName)
+		if !seen[workspace] {
+			seen[workspace] = true
+			workspaces = append(workspaces, workspace)
+		}
+	}
+
+	sort.Strings(workspaces)
+	return workspaces
+}
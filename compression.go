@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// responseCompressor compresses response bodies
+// with the algorithm the operator picked
+// if the client accepts it and the body is big enough
+type responseCompressor struct {
+	algorithm string
+	minBytes  int
+	// zstd encoders are expensive to create
+	// EncodeAll can be called concurrently though
+	zstdEncoder *zstd.Encoder
+}
+
+func newResponseCompressor(algorithm string, minBytes int) (*responseCompressor, error) {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	if algorithm == "" {
+		algorithm = compressionNone
+	}
+
+	rc := &responseCompressor{
+		algorithm: algorithm,
+		minBytes:  minBytes,
+	}
+
+	switch algorithm {
+	case compressionNone, compressionGzip:
+	case compressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		rc.zstdEncoder = enc
+	default:
+		return nil, fmt.Errorf("Unknown response compression [%s]", algorithm)
+	}
+
+	return rc, nil
+}
+
+// encodingFor returns the content encoding to use for a body of the given size
+// or an empty string if the body should go out uncompressed
+func (rc *responseCompressor) encodingFor(r *http.Request, size int) string {
+	if rc.algorithm == compressionNone || size < rc.minBytes {
+		return ""
+	}
+
+	if acceptsEncoding(r.Header.Get("Accept-Encoding"), rc.algorithm) {
+		return rc.algorithm
+	}
+
+	return ""
+}
+
+func (rc *responseCompressor) compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case compressionGzip:
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(data)
+		if err != nil {
+			return nil, err
+		}
+
+		err = gz.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case compressionZstd:
+		return rc.zstdEncoder.EncodeAll(data, make([]byte, 0, len(data))), nil
+	default:
+		return nil, fmt.Errorf("Unknown content encoding [%s]", encoding)
+	}
+}
+
+// errUnsupportedContentEncoding means a request body came in an encoding we can't decode
+var errUnsupportedContentEncoding = errors.New("Unsupported content encoding")
+
+// decodeRequestBody undoes the Content-Encoding of a request body
+// states are always stored uncompressed so their md5 is the one terraform expects
+func decodeRequestBody(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case compressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	default:
+		return nil, fmt.Errorf("Can't decode [%s]: %w", encoding, errUnsupportedContentEncoding)
+	}
+}
+
+// acceptsEncoding parses an Accept-Encoding header like "gzip;q=0.8, zstd"
+// and reports whether the encoding is acceptable to the client
+// an entry for the encoding itself wins over *, whatever the order
+func acceptsEncoding(header string, encoding string) bool {
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if coding == encoding {
+			return q > 0
+		}
+
+		wildcard = q
+	}
+
+	return wildcard > 0
+}
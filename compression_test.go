@@ -0,0 +1,45 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "testing"
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		accepted bool
+	}{
+		{"gzip", true},
+		{"gzip;q=0.8, zstd", true},
+		{"gzip;q=0", false},
+		{"zstd", false},
+		{"", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+		{"gzip;q=0, *", false},
+		{"zstd, *;q=0.5", true},
+	}
+
+	for _, c := range cases {
+		accepted := acceptsEncoding(c.header, compressionGzip)
+		if accepted != c.accepted {
+			t.Errorf("acceptsEncoding(%q, gzip) = %t, want %t", c.header, accepted, c.accepted)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configFileEnv names a file of KEY=VALUE lines that is layered over the environment
+// it's read at startup and again on SIGHUP, the environment of a running process can't change
+const configFileEnv = "CONFIG_FILE"
+
+// restartSettings only take effect at startup
+// a reload that changes them warns and keeps running with the old values
+var restartSettings = []string{
+	"PORT",
+	"DATABASE_URL",
+	"DB_HOST",
+	"DB_PORT",
+	"DB_USER",
+	"DB_PASSWORD",
+	"DB_NAME",
+	"DB_SSLMODE",
+	"BACKEND",
+	"STATE_SHARDS",
+	"ID_FORMAT",
+}
+
+// configFile puts the settings of the config file into the environment
+// and remembers what they shadowed, settings removed from the file
+// go back to their environment value on the next load
+type configFile struct {
+	path string
+	// the environment value of every key the file set, nil if it wasn't set
+	shadowed map[string]*string
+}
+
+func newConfigFile(path string) *configFile {
+	return &configFile{
+		path:     path,
+		shadowed: make(map[string]*string),
+	}
+}
+
+// load reads the file and applies it on top of the environment
+// without a file there is nothing to do
+func (cf *configFile) load() error {
+	if cf.path == "" {
+		return nil
+	}
+
+	settings, err := readConfigFile(cf.path)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range cf.shadowed {
+		if value == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *value)
+		}
+	}
+
+	cf.shadowed = make(map[string]*string)
+	for key, value := range settings {
+		if old, ok := os.LookupEnv(key); ok {
+			cf.shadowed[key] = &old
+		} else {
+			cf.shadowed[key] = nil
+		}
+
+		os.Setenv(key, value)
+	}
+
+	return nil
+}
+
+// readConfigFile parses KEY=VALUE lines
+// empty lines and lines starting with # are skipped
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("Line %d of [%s] needs to be KEY=VALUE but is [%s]", lineNumber, path, line)
+		}
+
+		settings[strings.TrimSpace(line[:idx])] = strings.TrimSpace(line[idx+1:])
+	}
+
+	return settings, scanner.Err()
+}
+
+// restartSnapshot is what the restart settings were at startup
+func restartSnapshot() map[string]string {
+	snapshot := make(map[string]string, len(restartSettings))
+	for _, key := range restartSettings {
+		snapshot[key] = os.Getenv(key)
+	}
+
+	return snapshot
+}
+
+// reloadableSettings can change while requests are being served
+// everything else needs a restart
+type reloadableSettings struct {
+	logLevel           logrus.Level
+	readOnly           bool
+	maintenanceMessage string
+	lockWaitTimeout    time.Duration
+	maxLockWaitTimeout time.Duration
+	lockChurnLimit     int
+	lockChurnWindow    time.Duration
+}
+
+func readReloadableSettings() (*reloadableSettings, error) {
+	logLevel, err := logrus.ParseLevel(getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &reloadableSettings{
+		logLevel:           logLevel,
+		readOnly:           getEnv("READ_ONLY", "false") == "true",
+		maintenanceMessage: os.Getenv("MAINTENANCE_MESSAGE"),
+	}
+
+	settings.lockWaitTimeout, err = parseEnvDuration("LOCK_WAIT_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// a LOCK that waits longer than the write timeout never gets its response
+	settings.maxLockWaitTimeout, err = parseEnvDuration("LOCK_WAIT_TIMEOUT_MAX", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.lockChurnLimit, err = parseEnvInt("LOCK_CHURN_LIMIT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.lockChurnWindow, err = parseEnvDuration("LOCK_CHURN_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// writeModes switches writes on and off, see backend.NewWritableStore
+type writeModes interface {
+	SetReadOnly(message string)
+	SetWritable()
+}
+
+// applyWriteMode turns writes off in maintenance and read-only mode
+// planned maintenance turns writes off like read-only mode
+// but tells clients why in the response
+func applyWriteMode(modes writeModes, settings *reloadableSettings) {
+	if settings.maintenanceMessage != "" {
+		logrus.Warnf("Running in maintenance mode: %s", settings.maintenanceMessage)
+		modes.SetReadOnly(settings.maintenanceMessage)
+	} else if settings.readOnly {
+		logrus.Warn("Running in read-only mode")
+		modes.SetReadOnly("")
+	} else {
+		modes.SetWritable()
+	}
+}
+
+// reloader applies changed settings to the running server on SIGHUP
+// connections and locks are left alone
+type reloader struct {
+	config  *configFile
+	server  *httpServer
+	modes   writeModes
+	restart map[string]string
+}
+
+func (rl *reloader) reload() {
+	logrus.Info("Reloading configuration")
+	err := rl.config.load()
+	if err != nil {
+		logrus.Errorf("Not reloading, can't read the config file: %s", err.Error())
+		return
+	}
+
+	for key, value := range rl.restart {
+		if os.Getenv(key) != value {
+			logrus.Warnf("%s can't change without a restart, ignoring it", key)
+		}
+	}
+
+	settings, err := readReloadableSettings()
+	if err != nil {
+		logrus.Errorf("Not reloading: %s", err.Error())
+		return
+	}
+
+	err = rl.server.lockChurn.configure(settings.lockChurnLimit, settings.lockChurnWindow)
+	if err != nil {
+		logrus.Errorf("Not reloading: %s", err.Error())
+		return
+	}
+
+	logrus.SetLevel(settings.logLevel)
+	applyWriteMode(rl.modes, settings)
+	rl.server.setLockWaits(settings.lockWaitTimeout, settings.maxLockWaitTimeout)
+	logrus.Infof("Configuration reloaded: log level %s, lock wait %s (max %s), lock churn limit %d per %s", settings.logLevel, settings.lockWaitTimeout, settings.maxLockWaitTimeout, settings.lockChurnLimit, settings.lockChurnWindow)
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connTracker knows the state of every open connection
+// so that a shutdown can tell how many requests it cut off
+type connTracker struct {
+	mutex sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[net.Conn]http.ConnState),
+	}
+}
+
+// connStateChanged is meant to be the ConnState hook of the http server
+func (ct *connTracker) connStateChanged(conn net.Conn, state http.ConnState) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(ct.conns, conn)
+	default:
+		ct.conns[conn] = state
+	}
+}
+
+// active returns the number of connections that are in the middle of a request
+func (ct *connTracker) active() int {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	active := 0
+	for _, state := range ct.conns {
+		if state == http.StateActive {
+			active++
+		}
+	}
+
+	return active
+}
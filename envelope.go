@@ -0,0 +1,90 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/mhelmich/tf-locker/backend"
+	"github.com/sirupsen/logrus"
+)
+
+// tools that want the metadata of a state next to it ask for this media type
+// terraform never does and keeps getting the raw state
+const envelopeMediaType = "application/vnd.tf-locker.envelope+json"
+
+// stateEnvelope wraps a state with its metadata
+type stateEnvelope struct {
+	Version int    `json:"version"`
+	MD5     string `json:"md5"`
+	Locked  bool   `json:"locked"`
+	// the state as it was written, null if there is none
+	State json.RawMessage `json:"state"`
+}
+
+// acceptsEnvelope tells whether the Accept header asks for the envelope explicitly
+// wildcards get the raw state
+func acceptsEnvelope(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		if mediaType == envelopeMediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *httpServer) writeStateEnvelope(w http.ResponseWriter, name string, stateID string) {
+	states, err := s.store.GetStates([]backend.StateRef{{StateID: stateID, Name: name}})
+	if err != nil {
+		logrus.Errorf("Get didn't work: %s", err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	_, err = s.store.GetLockInfo(stateID, name)
+	if err != nil && !errors.Is(err, backend.ErrNotLocked) {
+		logrus.Errorf("Can't get lock of [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	envelope := &stateEnvelope{
+		// a state without lock answers with ErrNotLocked
+		Locked: err == nil,
+	}
+	if len(states) > 0 {
+		data := states[0].Data
+		if !json.Valid(data) {
+			logrus.Errorf("State [%s] [%s] isn't json and can't be wrapped", name, stateID)
+			writeError(w, http.StatusNotAcceptable, "state isn't json and can't be wrapped in an envelope")
+			return
+		}
+
+		envelope.Version = states[0].Version
+		envelope.MD5 = md5Hash(data)
+		envelope.State = data
+	}
+
+	w.Header().Set("Vary", "Accept")
+	writeJSON(w, http.StatusOK, envelope)
+	logrus.Infof("GET: %s %s envelope version %d", name, stateID, envelope.Version)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	eventSinkNone  = "none"
+	eventSinkKafka = "kafka"
+
+	eventActionWrite    = "write"
+	eventActionDelete   = "delete"
+	eventActionUndelete = "undelete"
+	eventActionPurge    = "purge"
+	eventActionLock     = "lock"
+	eventActionUnlock   = "unlock"
+)
+
+var (
+	eventsDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tf_locker_events_dropped_total",
+		Help: "Number of state change events that were dropped because the buffer was full",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsDroppedCounter)
+}
+
+// stateEvent describes a successful change of a state
+type stateEvent struct {
+	Action    string    `json:"action"`
+	Name      string    `json:"name"`
+	StateID   string    `json:"state_id"`
+	Version   int       `json:"version,omitempty"`
+	MD5       string    `json:"md5,omitempty"`
+	Who       string    `json:"who,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// eventSink delivers events to a message broker
+type eventSink interface {
+	send(event *stateEvent) error
+	close() error
+}
+
+// eventPublisher hands events to a sink in the background
+// the buffer is bounded and events are dropped when it's full
+// that way a slow broker never holds up terraform
+type eventPublisher struct {
+	sink   eventSink
+	events chan *stateEvent
+	done   chan struct{}
+}
+
+// newEventPublisher returns nil if no sink is configured
+// a nil publisher drops all events
+func newEventPublisher(sinkName string, bufferSize int, brokers string, topic string) (*eventPublisher, error) {
+	var sink eventSink
+	var err error
+	switch sinkName {
+	case "", eventSinkNone:
+		return nil, nil
+	case eventSinkKafka:
+		sink, err = newKafkaSink(strings.Split(brokers, ","), topic)
+	default:
+		return nil, fmt.Errorf("Unknown event sink [%s]", sinkName)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &eventPublisher{
+		sink:   sink,
+		events: make(chan *stateEvent, bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go ep.run()
+	return ep, nil
+}
+
+func (ep *eventPublisher) run() {
+	defer close(ep.done)
+	for event := range ep.events {
+		err := ep.sink.send(event)
+		if err != nil {
+			logrus.Errorf("Can't publish %s event for [%s] [%s]: %s", event.Action, event.Name, event.StateID, err.Error())
+		}
+	}
+}
+
+func (ep *eventPublisher) publish(event *stateEvent) {
+	if ep == nil {
+		return
+	}
+
+	event.Timestamp = time.Now().UTC()
+	select {
+	case ep.events <- event:
+	default:
+		eventsDroppedCounter.Inc()
+		logrus.Warnf("Event buffer is full, dropping %s event for [%s] [%s]", event.Action, event.Name, event.StateID)
+	}
+}
+
+// close delivers the buffered events and closes the sink
+func (ep *eventPublisher) close() {
+	if ep == nil {
+		return
+	}
+
+	close(ep.events)
+	<-ep.done
+	err := ep.sink.close()
+	if err != nil {
+		logrus.Errorf("Can't close event sink: %s", err.Error())
+	}
+}
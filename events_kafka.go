@@ -0,0 +1,74 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/sirupsen/logrus"
+)
+
+// kafkaSink produces events to a kafka topic
+// events are keyed by state so that the events of one state stay in order
+type kafkaSink struct {
+	producer sarama.AsyncProducer
+	topic    string
+}
+
+func newKafkaSink(brokers []string, topic string) (*kafkaSink, error) {
+	config := sarama.NewConfig()
+	config.ClientID = "tf-locker"
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+	config.Producer.Return.Errors = true
+
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for err := range producer.Errors() {
+			logrus.Errorf("Can't produce event to [%s]: %s", topic, err.Err.Error())
+		}
+	}()
+
+	return &kafkaSink{
+		producer: producer,
+		topic:    topic,
+	}, nil
+}
+
+func (ks *kafkaSink) send(event *stateEvent) error {
+	bites, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ks.producer.Input() <- &sarama.ProducerMessage{
+		Topic:     ks.topic,
+		Key:       sarama.StringEncoder(event.Name + "/" + event.StateID),
+		Value:     sarama.ByteEncoder(bites),
+		Timestamp: event.Timestamp,
+	}
+
+	return nil
+}
+
+func (ks *kafkaSink) close() error {
+	return ks.producer.Close()
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxCapturedBody is how much of a request body is kept
+// states can be large, the beginning is usually enough to see what went wrong
+const maxCapturedBody = 1024 * 1024
+
+const redacted = "REDACTED"
+
+// redactedHeaders carry credentials and never end up on disk
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// failedRequest is a request that was answered with a 5xx
+type failedRequest struct {
+	Time    time.Time           `json:"time"`
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   map[string][]string `json:"query,omitempty"`
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body"`
+	// the body was longer than maxCapturedBody
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// requestCapture keeps the latest failed requests on disk for post-mortems
+// it's a ring buffer of one file per request, the oldest one is overwritten
+// the disk and not the database because the database is often what failed
+type requestCapture struct {
+	mutex     sync.Mutex
+	dir       string
+	retention int
+	next      int
+}
+
+func newRequestCapture(dir string, retention int) (*requestCapture, error) {
+	if retention < 1 {
+		return nil, fmt.Errorf("Failed request retention needs to be positive but is %d", retention)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &requestCapture{
+		dir:       dir,
+		retention: retention,
+	}
+
+	// pick up after the newest capture of a previous run
+	var newest time.Time
+	for slot := 0; slot < retention; slot++ {
+		info, err := os.Stat(rc.slotPath(slot))
+		if err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+			rc.next = (slot + 1) % retention
+		}
+	}
+
+	return rc, nil
+}
+
+func (rc *requestCapture) slotPath(slot int) string {
+	return filepath.Join(rc.dir, fmt.Sprintf("failed-request-%d.json", slot))
+}
+
+// save writes a failed request over the oldest one
+func (rc *requestCapture) save(fr *failedRequest) error {
+	bites, err := json.Marshal(fr)
+	if err != nil {
+		return err
+	}
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	// readers never see a half written capture
+	path := rc.slotPath(rc.next)
+	err = ioutil.WriteFile(path+".tmp", bites, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+
+	rc.next = (rc.next + 1) % rc.retention
+	return nil
+}
+
+// list returns the captured requests, the latest first
+func (rc *requestCapture) list() ([]*failedRequest, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	requests := make([]*failedRequest, 0, rc.retention)
+	for slot := 0; slot < rc.retention; slot++ {
+		bites, err := ioutil.ReadFile(rc.slotPath(slot))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		fr := &failedRequest{}
+		err = json.Unmarshal(bites, fr)
+		if err != nil {
+			logrus.Errorf("Skipping unreadable capture [%s]: %s", rc.slotPath(slot), err.Error())
+			continue
+		}
+
+		requests = append(requests, fr)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Time.After(requests[j].Time)
+	})
+	return requests, nil
+}
+
+// cappedBuffer keeps the first max bytes written to it
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	room := cb.max - cb.Len()
+	if len(p) > room {
+		cb.truncated = true
+		cb.Buffer.Write(p[:room])
+	} else {
+		cb.Buffer.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// captureFailedRequests saves requests that were answered with a 5xx
+// the body is copied while the handler reads it
+func captureFailedRequests(rc *requestCapture) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &cappedBuffer{max: maxCapturedBody}
+			r.Body = ioutil.NopCloser(io.TeeReader(r.Body, body))
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status < http.StatusInternalServerError {
+				return
+			}
+
+			err := rc.save(&failedRequest{
+				Time:      time.Now().UTC(),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Query:     redactQuery(r),
+				Status:    recorder.status,
+				Headers:   redactHeaders(r.Header),
+				Body:      body.Bytes(),
+				Truncated: body.truncated,
+			})
+			if err != nil {
+				logrus.Errorf("Can't capture failed request %s %s: %s", r.Method, r.URL.Path, err.Error())
+			}
+		})
+	}
+}
+
+func redactHeaders(header http.Header) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for key, values := range header {
+		headers[key] = values
+	}
+
+	for _, key := range redactedHeaders {
+		if _, ok := headers[key]; ok {
+			headers[key] = []string{redacted}
+		}
+	}
+
+	return headers
+}
+
+// redactQuery leaves out the token of signed urls, it stands in for credentials
+func redactQuery(r *http.Request) map[string][]string {
+	query := r.URL.Query()
+	for key := range query {
+		if strings.EqualFold(key, signedURLTokenParam) {
+			query[key] = []string{redacted}
+		}
+	}
+
+	return query
+}
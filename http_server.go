@@ -19,34 +19,282 @@ package main
 import (
 	"crypto/md5"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/mhelmich/tf-locker/backend"
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// state ids in routes that would be ambiguous otherwise
+const uuidPattern = "[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}"
+
 type httpServer struct {
 	http.Server
 
-	store backend.Store
+	store               backend.Store
+	compressor          *responseCompressor
+	writeSuccessStatus  int
+	compactRetention    int
+	versionsLimit       int
+	maxVersionsLimit    int
+	defaultStateName    string
+	events              *eventPublisher
+	backup              *stateBackup
+	minTerraformVersion *terraformVersion
+	exposeLockInfo      bool
+	conns               *connTracker
+	signer              *urlSigner
+	idFormat            *idFormat
+	namePattern         *regexp.Regexp
+	lockChurn           *churnLimiter
+	unlockMismatch      int
+	// nil if failed requests aren't captured
+	capture *requestCapture
+	// the lock waits can be reloaded while requests are served
+	lockWaitMutex      sync.RWMutex
+	lockWaitTimeout    time.Duration
+	maxLockWaitTimeout time.Duration
+	// set once the node is draining for a restart, new locks are refused
+	draining int32
+	// nil if requests aren't authenticated
+	auth authenticator
+	// nil if everybody may do everything
+	policy *policy
+	// paths that are served without authentication
+	publicPaths       map[string]bool
+	trustProxyHeaders bool
+}
+
+// httpServerConfig carries the knobs main reads from the environment
+type httpServerConfig struct {
+	port int
+	// HTTP methods terraform uses for locking and unlocking
+	// some proxies reject the non-standard LOCK/UNLOCK
+	// terraforms lock_method/unlock_method need to match these
+	lockMethod   string
+	unlockMethod string
+	// paths of the operational endpoints
+	// they can be moved when they collide with ingress conventions
+	healthPath  string
+	metricsPath string
+	// response compression algorithm (none, gzip, zstd)
+	// and the body size below which responses go out uncompressed
+	compression         string
+	compressionMinBytes int
+	// status code for successful writes, deletes and unlocks
+	// either 200 (what terraform is used to) or 204
+	writeSuccessStatus int
+	// how long a contended LOCK waits for the lock to be released
+	// zero means LOCK fails right away
+	// X-Lock-Timeout overrides it for one request up to maxLockWaitTimeout
+	lockWaitTimeout    time.Duration
+	maxLockWaitTimeout time.Duration
+	// number of versions per state /admin/compact keeps by default
+	compactRetention int
+	// number of versions /versions lists unless ?limit= asks for a different number
+	// up to maxVersionsLimit
+	versionsLimit    int
+	maxVersionsLimit int
+	// name of the states behind /state/{state_id}
+	// empty means only the routes with a name are served
+	defaultStateName string
+	// receives an event for every successful change of a state
+	// nil turns events off
+	events *eventPublisher
+	// gets a copy of every written version
+	// nil turns backups off
+	backup *stateBackup
+	// states written by older terraform versions are rejected
+	// empty turns the check off
+	minTerraformVersion string
+	// take the client address from X-Forwarded-For/X-Real-IP
+	// only safe behind a proxy that sets these headers
+	trustProxyHeaders bool
+	// tell readers of a locked state who holds the lock in X-Lock-Info
+	exposeLockInfo bool
+	// key of the hmac signed urls are signed with and how long they are good for
+	// empty turns signed urls off
+	signedURLSecret string
+	signedURLTTL    time.Duration
+	// timeouts of the http server
+	// idle connections are kept around for clients that send many requests
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	// clients that trickle in their headers hold on to a connection
+	// until the header timeout cuts them off
+	readHeaderTimeout time.Duration
+	maxHeaderBytes    int
+	// serve HTTP/2 without TLS (h2c) next to HTTP/1.1
+	h2c bool
+	// format state ids need to have, uuid, ulid or any-safe
+	idFormat string
+	// regex every state name needs to match in full
+	// workspaces are part of the name as name:workspace
+	// empty accepts any valid name
+	stateNamePattern string
+	// connections start with a PROXY protocol v1/v2 header
+	// that carries the client address behind an L4 load balancer
+	proxyProtocol bool
+	// number of LOCKs and UNLOCKs a state gets per window
+	// zero turns the limit off
+	lockChurnLimit  int
+	lockChurnWindow time.Duration
+	// status of an UNLOCK with a lock id that doesn't hold the lock
+	unlockMismatchStatus int
+	// keep the latest failedRequestsRetention requests answered with a 5xx
+	// in failedRequestsDir for /admin/failed-requests
+	captureFailedRequests   bool
+	failedRequestsDir       string
+	failedRequestsRetention int
+	// tells who a request comes from, nil lets everybody in
+	// health and metrics are always served without
+	auth authenticator
+	// what the authenticated clients may do, nil lets them do everything
+	policy *policy
 }
 
-func startNewHTTPServer(port int, store backend.Store) (*httpServer, error) {
-	router := mux.NewRouter().StrictSlash(true)
+func startNewHTTPServer(cfg httpServerConfig, store backend.Store) (*httpServer, error) {
+	compressor, err := newResponseCompressor(cfg.compression, cfg.compressionMinBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.writeSuccessStatus != http.StatusOK && cfg.writeSuccessStatus != http.StatusNoContent {
+		return nil, fmt.Errorf("Write success status needs to be %d or %d but is %d", http.StatusOK, http.StatusNoContent, cfg.writeSuccessStatus)
+	}
+
+	if cfg.versionsLimit < 1 || cfg.maxVersionsLimit < cfg.versionsLimit {
+		return nil, fmt.Errorf("Versions limit needs to be positive and at most %d but is %d", cfg.maxVersionsLimit, cfg.versionsLimit)
+	}
+
+	err = checkLockMethods(cfg.lockMethod, cfg.unlockMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(cfg.defaultStateName, backend.WorkspaceSeparator) {
+		return nil, fmt.Errorf("Default state name [%s] can't contain %s", cfg.defaultStateName, backend.WorkspaceSeparator)
+	}
+
+	if cfg.unlockMismatchStatus < 400 || cfg.unlockMismatchStatus > 499 {
+		return nil, fmt.Errorf("Unlock mismatch status needs to be a 4xx status but is %d", cfg.unlockMismatchStatus)
+	}
+
+	var minTerraformVersion *terraformVersion
+	if cfg.minTerraformVersion != "" {
+		v, err := parseTerraformVersion(cfg.minTerraformVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		minTerraformVersion = &v
+	}
+
+	idFormat, err := newIDFormat(cfg.idFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var namePattern *regexp.Regexp
+	if cfg.stateNamePattern != "" {
+		namePattern, err = regexp.Compile("^(?:" + cfg.stateNamePattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Can't compile state name pattern [%s]: %s", cfg.stateNamePattern, err.Error())
+		}
+	}
+
+	// names can contain encoded slashes like team%2Fproject
+	// routing on the encoded path keeps them in one segment
+	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
+	conns := newConnTracker()
+	var handler http.Handler = router
+	if cfg.h2c {
+		// TLS is terminated in front of tf-locker if at all
+		// h2c lets proxies and clients multiplex requests over one plaintext connection
+		handler = h2c.NewHandler(router, &http2.Server{IdleTimeout: cfg.idleTimeout})
+	}
+
 	httpServer := &httpServer{
 		Server: http.Server{
-			Addr:         fmt.Sprintf(":%d", port),
-			Handler:      router,
-			WriteTimeout: time.Second * 60,
-			ReadTimeout:  time.Second * 60,
-			IdleTimeout:  time.Second * 60,
+			Addr:              fmt.Sprintf(":%d", cfg.port),
+			Handler:           handler,
+			WriteTimeout:      cfg.writeTimeout,
+			ReadTimeout:       cfg.readTimeout,
+			IdleTimeout:       cfg.idleTimeout,
+			ReadHeaderTimeout: cfg.readHeaderTimeout,
+			MaxHeaderBytes:    cfg.maxHeaderBytes,
+			ConnState:         conns.connStateChanged,
 		},
-		store: store,
+		store:               store,
+		compressor:          compressor,
+		writeSuccessStatus:  cfg.writeSuccessStatus,
+		unlockMismatch:      cfg.unlockMismatchStatus,
+		compactRetention:    cfg.compactRetention,
+		versionsLimit:       cfg.versionsLimit,
+		maxVersionsLimit:    cfg.maxVersionsLimit,
+		defaultStateName:    cfg.defaultStateName,
+		events:              cfg.events,
+		backup:              cfg.backup,
+		minTerraformVersion: minTerraformVersion,
+		exposeLockInfo:      cfg.exposeLockInfo,
+		conns:               conns,
+		idFormat:            idFormat,
+		namePattern:         namePattern,
+	}
+
+	if cfg.policy != nil && cfg.auth == nil {
+		return nil, fmt.Errorf("Policies need clients to authenticate, AUTH_MODE can't be none")
+	}
+
+	httpServer.auth = cfg.auth
+	httpServer.policy = cfg.policy
+	httpServer.trustProxyHeaders = cfg.trustProxyHeaders
+	httpServer.publicPaths = map[string]bool{
+		"/":             true,
+		cfg.healthPath:  true,
+		cfg.metricsPath: true,
+	}
+	if cfg.signedURLSecret != "" {
+		httpServer.signer = newURLSigner(cfg.signedURLSecret, cfg.signedURLTTL)
+	}
+
+	if cfg.captureFailedRequests {
+		httpServer.capture, err = newRequestCapture(cfg.failedRequestsDir, cfg.failedRequestsRetention)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	httpServer.setLockWaits(cfg.lockWaitTimeout, cfg.maxLockWaitTimeout)
+	httpServer.lockChurn, err = newChurnLimiter(cfg.lockChurnLimit, cfg.lockChurnWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.defaultStateName != "" {
+		httpServer.registerDefaultNameRoutes(router, cfg)
 	}
 
 	router.
@@ -55,6 +303,18 @@ func startNewHTTPServer(port int, store backend.Store) (*httpServer, error) {
 		HandlerFunc(httpServer.getState).
 		Name("getState")
 
+	router.
+		Methods("HEAD").
+		Path("/state/{name}/{state_id}").
+		HandlerFunc(httpServer.stateExists).
+		Name("headState")
+
+	router.
+		Methods("GET").
+		Path("/state/{name}/{state_id}/exists").
+		HandlerFunc(httpServer.stateExists).
+		Name("stateExists")
+
 	router.
 		Methods("POST", "PUT").
 		Path("/state/{name}/{state_id}").
@@ -68,179 +328,1765 @@ func startNewHTTPServer(port int, store backend.Store) (*httpServer, error) {
 		Name("deleteState")
 
 	router.
-		Methods("LOCK").
+		Methods(cfg.lockMethod).
 		Path("/state/{name}/{state_id}").
 		HandlerFunc(httpServer.lockState).
 		Name("lockState")
 
 	router.
-		Methods("UNLOCK").
+		Methods(cfg.unlockMethod).
 		Path("/state/{name}/{state_id}").
 		HandlerFunc(httpServer.unlockState).
 		Name("unlockState")
 
-	go httpServer.ListenAndServe()
+	// POST based locking for deployments behind proxies
+	// that don't let custom http methods through
+	// point terraforms lock_address/unlock_address at these
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/lock").
+		HandlerFunc(httpServer.lockState).
+		Name("lockStatePost")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/unlock").
+		HandlerFunc(httpServer.unlockState).
+		Name("unlockStatePost")
+
+	router.
+		Methods("GET").
+		Path("/state/{name}/{state_id}/lock").
+		HandlerFunc(httpServer.getLockInfo).
+		Name("getLockInfo")
+
+	router.
+		Methods("GET").
+		Path("/state/{name}/{state_id}/lock/verify").
+		HandlerFunc(httpServer.verifyLock).
+		Name("verifyLock")
+
+	router.
+		Methods("GET").
+		Path("/state/{name}/{state_id}/versions").
+		HandlerFunc(httpServer.listVersions).
+		Name("listVersions")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/commit").
+		HandlerFunc(httpServer.commitState).
+		Name("commitState")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/force-unlock").
+		HandlerFunc(httpServer.forceUnlockState).
+		Name("forceUnlockState")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/lock-and-get").
+		HandlerFunc(httpServer.lockAndGetState).
+		Name("lockAndGetState")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/undelete").
+		HandlerFunc(httpServer.undeleteState).
+		Name("undeleteState")
+
+	router.
+		Methods("POST").
+		Path("/state/{name}/{state_id}/copy").
+		HandlerFunc(httpServer.copyState).
+		Name("copyState")
+
+	if httpServer.signer != nil {
+		router.
+			Methods("POST").
+			Path("/state/{name}/{state_id}/signed-url").
+			HandlerFunc(httpServer.createSignedURL).
+			Name("createSignedURL")
+	}
+
+	// the same operations for a workspace of a configuration
+	// these need to go after the routes with a fixed last segment
+	// otherwise .../lock would be taken as a state id
+	httpServer.registerWorkspaceRoutes(router, cfg)
+
+	router.
+		Methods("POST").
+		Path("/states/batch").
+		HandlerFunc(httpServer.getStates).
+		Name("getStates")
+
+	router.
+		Methods("GET").
+		Path("/workspaces/{name}").
+		HandlerFunc(httpServer.listWorkspaces).
+		Name("listWorkspaces")
+
+	router.
+		Methods("GET").
+		Path("/names").
+		HandlerFunc(httpServer.listNames).
+		Name("listNames")
+
+	router.
+		Methods("GET").
+		Path("/admin/locks").
+		HandlerFunc(httpServer.listLocks).
+		Name("listLocks")
+
+	router.
+		Methods("POST").
+		Path("/admin/compact").
+		HandlerFunc(httpServer.compact).
+		Name("compact")
+
+	if httpServer.capture != nil {
+		router.
+			Methods("GET").
+			Path("/admin/failed-requests").
+			HandlerFunc(httpServer.listFailedRequests).
+			Name("listFailedRequests")
+	}
+
+	router.
+		Methods("GET").
+		Path(cfg.healthPath).
+		HandlerFunc(httpServer.healthCheck).
+		Name("healthCheck")
+
+	router.
+		Methods("GET").
+		Path("/").
+		HandlerFunc(httpServer.rootStatus).
+		Name("rootStatus")
+
+	router.
+		Methods("GET").
+		Path(cfg.metricsPath).
+		Handler(promhttp.Handler()).
+		Name("metrics")
+
+	// goes first so that the identity it found is the one that's logged
+	if httpServer.auth != nil {
+		router.Use(httpServer.authenticate)
+	}
+
+	router.Use(requestLogger(cfg.trustProxyHeaders))
+	// after the logger so that refusals make it into the audit trail
+	if httpServer.policy != nil {
+		router.Use(httpServer.authorize)
+	}
+
+	if httpServer.capture != nil {
+		logrus.Infof("Capturing failed requests in %s", cfg.failedRequestsDir)
+		router.Use(captureFailedRequests(httpServer.capture))
+	}
+
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.proxyProtocol {
+		// the remote address of every connection becomes the one in the header
+		// a client that doesn't send the header in time is cut off
+		listener = &proxyproto.Listener{
+			Listener: &headerDeadlineListener{Listener: listener, timeout: cfg.readTimeout},
+		}
+	}
+
+	go httpServer.Serve(listener)
 	return httpServer, nil
 }
 
 func (s *httpServer) getState(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
+	vars := pathVars(r)
+	name := s.stateName(vars)
 	stateID := vars["state_id"]
-	defer r.Body.Close()
 
-	data, err := s.store.GetState(stateID, name)
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
 	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	// a signed url stands in for credentials, a bad one is never let through
+	token := r.URL.Query().Get(signedURLTokenParam)
+	if s.signer != nil && token != "" {
+		st, err := s.signer.verify(token, name, stateID, r.Method)
+		if err != nil {
+			logrus.Errorf("Rejecting signed url for [%s] [%s]: %s", name, stateID, err.Error())
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		logrus.Infof("GET: %s %s with a signed url of %s", name, stateID, st.Issuer)
+	}
+
+	// reading the backup tier is for disaster recovery drills
+	switch r.URL.Query().Get("source") {
+	case "":
+	case "backup":
+		s.getBackup(w, r, name, stateID)
+		return
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown source [%s]", r.URL.Query().Get("source")))
+		return
+	}
+
+	if acceptsEnvelope(r.Header.Get("Accept")) {
+		s.writeStateEnvelope(w, name, stateID)
+		return
+	}
+
+	var data []byte
+	var li *backend.LockInfo
+	if s.exposeLockInfo {
+		data, li, err = s.store.GetStateAndLock(stateID, name)
+	} else {
+		data, err = s.store.GetState(stateID, name)
+	}
+	if errors.Is(err, backend.ErrStaleState) {
+		// a plan against a slightly old state beats a failed plan
+		logrus.Warnf("Serving stale state [%s] [%s]: %s", name, stateID, err.Error())
+		staleReadsCounter.Inc()
+		w.Header().Set("Warning", `110 tf-locker "Response is Stale"`)
+	} else if err != nil {
 		logrus.Errorf("Get didn't work: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeStoreError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if li != nil {
+		// reading a locked state is fine but the reader might be looking at it mid-apply
+		header, err := json.Marshal(&lockInfoHeader{ID: li.ID, Operation: li.Operation, Who: li.Who})
+		if err == nil {
+			w.Header().Set(lockInfoHeaderName, string(header))
+		}
+	}
+
+	s.writeStateBody(w, r, name, stateID, data)
+}
+
+// getBackup sends the latest backed up version of a state
+func (s *httpServer) getBackup(w http.ResponseWriter, r *http.Request, name string, stateID string) {
+	if s.backup == nil {
+		writeError(w, http.StatusNotFound, "Backups aren't configured")
+		return
+	}
+
+	data, version, err := s.backup.latest(r.Context(), name, stateID)
+	if err != nil {
+		logrus.Errorf("Can't read backup of [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	logrus.Infof("GET: %s %s version %d from the backup", name, stateID, version)
+	w.Header().Set("X-State-Version", strconv.Itoa(version))
+	s.writeStateBody(w, r, name, stateID, data)
+}
+
+const lockInfoHeaderName = "X-Lock-Info"
+
+// lockInfoHeader is the part of the lock info that goes into X-Lock-Info
+type lockInfoHeader struct {
+	ID        string
+	Operation string
+	Who       string
+}
+
+// writeStateBody sends a state the way terraform expects it from a GET
+func (s *httpServer) writeStateBody(w http.ResponseWriter, r *http.Request, name string, stateID string, data []byte) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
 	var b64 string
 	if len(data) > 0 {
+		// the md5 is always computed over the uncompressed state
+		// that's what terraform verifies after decoding
 		b64 = md5Hash(data)
 		logrus.Infof("send data: %d %s", len(data), b64)
 		w.Header().Set("Content-MD5", b64)
-		w.Write(data)
+
+		encoding := s.compressor.encodingFor(r, len(data))
+		if encoding != "" {
+			compressed, err := s.compressor.compress(encoding, data)
+			if err != nil {
+				logrus.Errorf("Can't compress state [%s] [%s]: %s", name, stateID, err.Error())
+			} else {
+				w.Header().Set("Content-Encoding", encoding)
+				data = compressed
+			}
+		}
 	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+
 	logrus.Infof("GET: %s %s %d %s", name, stateID, len(data), b64)
 }
 
-func (s *httpServer) setState(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	stateID := vars["state_id"]
+const maxBatchSize = 100
+
+type batchStateResult struct {
+	StateID string `json:"state_id"`
+	Name    string `json:"name"`
+	// ok, not_found or invalid
+	Status  string `json:"status"`
+	Version int    `json:"version,omitempty"`
+	// encoding/json sends byte slices as base64
+	Data []byte `json:"data,omitempty"`
+}
+
+func (s *httpServer) getStates(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	err := s.validateIDs(name, stateID)
+	refs := make([]backend.StateRef, 0)
+	err := json.NewDecoder(r.Body).Decode(&refs)
 	if err != nil {
-		logrus.Errorf("Invalid state_id: %s %s", name, stateID)
+		logrus.Errorf("Can't deserialize batch request: %s", err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Can't parse batch request: %s", err.Error()))
+		return
+	} else if len(refs) > maxBatchSize {
+		logrus.Errorf("Batch of %d states is too big (> %d)", len(refs), maxBatchSize)
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Batch of %d states is larger than %d", len(refs), maxBatchSize))
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	results := make([]*batchStateResult, len(refs))
+	validRefs := make([]backend.StateRef, 0, len(refs))
+	for idx, ref := range refs {
+		results[idx] = &batchStateResult{
+			StateID: ref.StateID,
+			Name:    ref.Name,
+			Status:  "not_found",
+		}
+
+		refName, refWorkspace := backend.SplitStateName(ref.Name)
+		if s.validateIDs(refName, refWorkspace, ref.StateID) != nil {
+			results[idx].Status = "invalid"
+			continue
+		}
+
+		validRefs = append(validRefs, ref)
+	}
+
+	states, err := s.store.GetStates(validRefs)
 	if err != nil {
-		logrus.Errorf("Can't deserialize request body: %s", err.Error())
+		logrus.Errorf("Batch get didn't work: %s", err.Error())
+		writeStoreError(w, err)
+		return
 	}
-	defer r.Body.Close()
 
-	lockID := r.URL.Query().Get("ID")
-	if lockID == "" {
-		logrus.Info("Empty lock id...")
+	// postgres hands back state ids in their canonical form
+	found := make(map[backend.StateRef]*backend.VersionedState)
+	for _, state := range states {
+		found[backend.StateRef{StateID: strings.ToLower(state.StateID), Name: state.Name}] = state
 	}
 
-	err = s.store.UpsertState(stateID, name, lockID, body)
-	if err != nil {
-		logrus.Errorf("Can't upsert state: %s", err.Error())
+	for _, result := range results {
+		if result.Status == "invalid" {
+			continue
+		}
+
+		state, ok := found[backend.StateRef{StateID: strings.ToLower(result.StateID), Name: result.Name}]
+		if ok {
+			result.Status = "ok"
+			result.Version = state.Version
+			result.Data = state.Data
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	logrus.Infof("SET: %s %s %d %s", name, stateID, len(body), md5Hash(body))
+	writeJSON(w, http.StatusOK, results)
+	logrus.Infof("BATCH-GET: %d requested %d found", len(refs), len(states))
 }
 
-func (s *httpServer) deleteState(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
+// blobSizeHeader tells HEAD requests how big a state is, they don't get a body
+const blobSizeHeader = "X-Blob-Size"
+
+// stateMeta describes a state without sending it
+type stateMeta struct {
+	// bytes the latest version takes up in the database
+	BlobSize int `json:"blob_size"`
+}
+
+// stateExists answers 404 for states without data
+// and tells how big the state is otherwise
+func (s *httpServer) stateExists(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
 	stateID := vars["state_id"]
-	logrus.Infof("Deleting state: %s %s", name, stateID)
 	defer r.Body.Close()
 
-	err := s.store.DeleteState(stateID, name)
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
 	if err != nil {
-		logrus.Errorf("Can't delete state [%s] [%s]: %s", name, stateID, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	logrus.Infof("DELETE: %s %s", name, stateID)
+	size, err := s.store.StateSize(stateID, name)
+	if err != nil {
+		logrus.Errorf("Exists didn't work: %s", err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	if size == 0 {
+		writeError(w, http.StatusNotFound, "state doesn't exist")
+		return
+	}
+
+	w.Header().Set(blobSizeHeader, strconv.Itoa(size))
+	writeJSON(w, http.StatusOK, &stateMeta{BlobSize: size})
+	logrus.Infof("EXISTS: %s %s %d", name, stateID, size)
 }
 
-func (s *httpServer) lockState(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	stateID := vars["state_id"]
+func (s *httpServer) setState(w http.ResponseWriter, r *http.Request) {
+	// auto_unlock=true releases the lock together with the write
+	// and saves the client the separate unlock request
+	s.writeState(w, r, r.URL.Query().Get("auto_unlock") == "true")
+}
 
-	// query database to see whether a lock state exists already
-	// if not, return 200
-	// if it does, return error and put the lock info into the body
-	// http.StatusConflict, http.StatusLocked:
-	// https://www.terraform.io/docs/backends/types/http.html
+// commitState writes the state and releases the lock in one transaction
+// a crash can't leave the lock behind after the write went through
+func (s *httpServer) commitState(w http.ResponseWriter, r *http.Request) {
+	s.writeState(w, r, true)
+}
 
+// writeState stores the state in the body of a request
+// with autoUnlock the lock given in ?ID= is released as well
+func (s *httpServer) writeState(w http.ResponseWriter, r *http.Request, autoUnlock bool) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
 	defer r.Body.Close()
-	body, err := ioutil.ReadAll(r.Body)
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
 	if err != nil {
-		logrus.Errorf("Can't read request body: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// the body should contain the entire lock info
-	// something like this:
-	// {\"ID\":\"21372f90-cb29-bbdf-0fea-75240e6d00bc\",\"Operation\":\"OperationTypeApply\",\"Info\":\"\",\"Who\":\"marco.helmich@live.com\",\"Version\":\"0.11.8\",\"Created\":\"2018-09-06T20:08:23.494957724Z\",\"Path\":\"\"}"
+	// a body that can't be read completely is never stored
+	// otherwise a broken upload would persist a truncated state
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Errorf("Can't read request body of [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Can't read request body: %s", err.Error()))
+		return
+	}
 
-	err = s.store.LockState(stateID, name, string(body))
-	if err == backend.ErrAlreadyLocked {
-		logrus.Infof("LOCK: already locked %s %s", name, stateID)
-		w.WriteHeader(http.StatusLocked)
+	body, err = decodeRequestBody(r.Header.Get("Content-Encoding"), body)
+	if errors.Is(err, errUnsupportedContentEncoding) {
+		logrus.Errorf("Can't decode state [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusUnsupportedMediaType, err.Error())
 		return
 	} else if err != nil {
-		logrus.Errorf("locking failed [%s] [%s]: %s", name, stateID, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logrus.Errorf("Malformed %s body for [%s] [%s]: %s", r.Header.Get("Content-Encoding"), name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Malformed %s body: %s", r.Header.Get("Content-Encoding"), err.Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	logrus.Infof("LOCK: %s %s", name, stateID)
-}
+	if s.minTerraformVersion != nil && len(body) > 0 {
+		err = checkTerraformVersion(body, *s.minTerraformVersion)
+		if err != nil {
+			logrus.Errorf("Rejecting state [%s] [%s]: %s", name, stateID, err.Error())
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
 
-func (s *httpServer) unlockState(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	stateID := vars["state_id"]
-	defer r.Body.Close()
+	lockID := r.URL.Query().Get("ID")
+	if lockID == "" {
+		logrus.Info("Empty lock id...")
+	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logrus.Errorf("Can't deserialize request body: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	if autoUnlock && lockID == "" {
+		logrus.Errorf("Can't unlock [%s] [%s] after the write without lock id", name, stateID)
+		writeError(w, http.StatusBadRequest, "Releasing the lock with the write needs the lock ID")
 		return
 	}
 
-	// the body now contains only the lock id
-	// not even a json object with the lock id...just the lock id
-	// something like this: 21372f90-cb29-bbdf-0fea-75240e6d00bc
-
-	logrus.Infof("UNLOCK: body %s", string(body))
-
-	err = s.store.UnlockState(stateID, name, string(body))
-	if err != nil {
-		logrus.Errorf("unlocking failed [%s] [%s]: %s", name, stateID, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	// If-Match carries the md5 of the state the client read
+	// the write only goes through if nobody changed the state since
+	ifMatch := strings.Trim(r.Header.Get("If-Match"), `" `)
+	if ifMatch != "" && autoUnlock {
+		logrus.Errorf("Can't unlock [%s] [%s] after the write with If-Match", name, stateID)
+		writeError(w, http.StatusBadRequest, "Releasing the lock with the write can't be combined with If-Match")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	logrus.Infof("UNLOCK: %s %s", name, stateID)
-}
+	// retries of a write carry the same key
+	// and get the result of the write that went through
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > 255 {
+		logrus.Errorf("Idempotency key too long (> 255): %s", idempotencyKey)
+		writeError(w, http.StatusBadRequest, "Idempotency-Key is longer than 255 characters")
+		return
+	}
 
-func (s *httpServer) validateIDs(name string, id string) error {
-	_, err := uuid.Parse(id)
+	var result backend.WriteResult
+	if autoUnlock {
+		result, err = s.store.CommitAndUnlock(stateID, name, lockID, body, idempotencyKey)
+	} else if ifMatch != "" {
+		result, err = s.store.ReplaceState(stateID, name, lockID, body, ifMatch, idempotencyKey)
+	} else {
+		result, err = s.store.UpsertState(stateID, name, lockID, body, idempotencyKey)
+	}
+	countConflict(name, err)
 	if err != nil {
-		return fmt.Errorf("Can't parse uuid [%s]: %s", id, err.Error())
+		logrus.Errorf("Can't upsert state: %s", err.Error())
+		writeStoreError(w, err)
+		return
 	}
 
-	if len(name) > 64 {
-		return fmt.Errorf("String too long (> 64): %s", name)
+	w.Header().Set("X-State-Version", strconv.Itoa(result.Version))
+	// retries of writes from before serials were kept with idempotency keys don't have one
+	if result.Serial > 0 {
+		w.Header().Set("X-State-Serial", strconv.FormatInt(result.Serial, 10))
 	}
 
-	return nil
+	// terraform takes a 201 as well as the configured status
+	if result.Created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(s.writeSuccessStatus)
+	}
+	hash := md5Hash(body)
+	logrus.Infof("SET: %s %s %d %s", name, stateID, len(body), hash)
+	s.events.publish(&stateEvent{
+		Action:  eventActionWrite,
+		Name:    name,
+		StateID: stateID,
+		Version: result.Version,
+		MD5:     hash,
+		Who:     identityFromContext(r.Context()),
+	})
+	s.backup.backup(name, stateID, result.Version, body)
+	if autoUnlock {
+		logrus.Infof("UNLOCK: %s %s", name, stateID)
+		s.events.publish(&stateEvent{
+			Action:  eventActionUnlock,
+			Name:    name,
+			StateID: stateID,
+			Who:     identityFromContext(r.Context()),
+		})
+	}
 }
 
-func md5Hash(data []byte) string {
-	hash := md5.Sum(data)
-	return base64.StdEncoding.EncodeToString(hash[:])
+func (s *httpServer) deleteState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	logrus.Infof("Deleting state: %s %s", name, stateID)
+	defer r.Body.Close()
+
+	// a locked state can only be deleted by the lock holder
+	// force=true deletes it anyways and breaks the lock
+	lockID := r.URL.Query().Get("ID")
+	force := r.URL.Query().Get("force") == "true"
+	if r.URL.Query().Get("purge") == "true" {
+		s.purgeState(w, r, name, stateID, force)
+		return
+	}
+
+	// If-Match carries the version the client expects to delete
+	expectedVersion := 0
+	ifMatch := strings.Trim(r.Header.Get("If-Match"), `" `)
+	if ifMatch != "" {
+		expectedVersion, err = strconv.Atoi(ifMatch)
+		if err != nil || expectedVersion < 1 {
+			logrus.Errorf("Invalid If-Match version [%s] for [%s] [%s]", ifMatch, name, stateID)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("If-Match needs to be a state version but is [%s]", ifMatch))
+			return
+		}
+	}
+
+	err = s.store.DeleteState(stateID, name, lockID, force, expectedVersion)
+	countConflict(name, err)
+	if errors.Is(err, backend.ErrAlreadyLocked) {
+		logrus.Infof("DELETE: locked %s %s", name, stateID)
+		writeStoreError(w, err)
+		return
+	} else if err != nil {
+		logrus.Errorf("Can't delete state [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(s.writeSuccessStatus)
+	logrus.Infof("DELETE: %s %s", name, stateID)
+	s.events.publish(&stateEvent{
+		Action:  eventActionDelete,
+		Name:    name,
+		StateID: stateID,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+// purgeState erases every version of a state
+// unlike a delete it can't be undone
+func (s *httpServer) purgeState(w http.ResponseWriter, r *http.Request, name string, stateID string, force bool) {
+	err := s.store.PurgeState(stateID, name, force)
+	countConflict(name, err)
+	if err != nil {
+		logrus.Errorf("Can't purge state [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(s.writeSuccessStatus)
+	logrus.Warnf("PURGE: %s %s force: %t", name, stateID, force)
+	s.events.publish(&stateEvent{
+		Action:  eventActionPurge,
+		Name:    name,
+		StateID: stateID,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+// undeleteState restores a soft-deleted state within the recovery window
+func (s *httpServer) undeleteState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	version, err := s.store.UndeleteState(stateID, name)
+	countConflict(name, err)
+	if err != nil {
+		logrus.Errorf("Can't undelete state [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("X-State-Version", strconv.Itoa(version))
+	w.WriteHeader(s.writeSuccessStatus)
+	logrus.Warnf("UNDELETE: %s %s %d", name, stateID, version)
+	s.events.publish(&stateEvent{
+		Action:  eventActionUndelete,
+		Name:    name,
+		StateID: stateID,
+		Version: version,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+// copyTarget is the body of a copy request
+type copyTarget struct {
+	Name    string `json:"name"`
+	StateID string `json:"state_id"`
+}
+
+// copyState writes the latest version of a state as the first version of a new state
+func (s *httpServer) copyState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	target := &copyTarget{}
+	err = json.NewDecoder(r.Body).Decode(target)
+	if err != nil {
+		logrus.Errorf("Can't parse copy target: %s", err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Can't parse copy target: %s", err.Error()))
+		return
+	}
+
+	targetName, targetWorkspace := backend.SplitStateName(target.Name)
+	err = s.validateIDs(targetName, targetWorkspace, target.StateID)
+	if err != nil || target.Name == "" {
+		logrus.Errorf("Invalid copy target [%s] [%s]", target.Name, target.StateID)
+		writeError(w, http.StatusBadRequest, "Copy target needs a name and a state_id")
+		return
+	}
+
+	// the middleware only saw the source
+	if !s.authorized(r, target.Name) {
+		logrus.Warnf("Policy doesn't allow [%s] to copy to [%s]", authenticatedPrincipal(r), target.Name)
+		writeError(w, http.StatusForbidden, "Not allowed by policy")
+		return
+	}
+
+	err = s.store.CopyState(stateID, name, target.StateID, target.Name)
+	if err != nil {
+		logrus.Errorf("Can't copy [%s] [%s] to [%s] [%s]: %s", name, stateID, target.Name, target.StateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(s.writeSuccessStatus)
+	logrus.Infof("COPY: %s %s to %s %s", name, stateID, target.Name, target.StateID)
+	s.events.publish(&stateEvent{
+		Action:  eventActionWrite,
+		Name:    target.Name,
+		StateID: target.StateID,
+		Version: 1,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+func (s *httpServer) lockState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// query database to see whether a lock state exists already
+	// if not, return 200
+	// if it does, return error and put the lock info into the body
+	// http.StatusConflict, http.StatusLocked:
+	// https://www.terraform.io/docs/backends/types/http.html
+
+	defer r.Body.Close()
+	if s.refuseWhileDraining(w, name, stateID) || s.refuseLockChurn(w, name, stateID) {
+		return
+	}
+
+	body, err := readLockInfo(r)
+	if err != nil {
+		logrus.Errorf("Invalid lock info for [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wait, err := s.lockWait(r)
+	if err != nil {
+		logrus.Errorf("Invalid lock timeout for [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the body should contain the entire lock info
+	// something like this:
+	// {\"ID\":\"21372f90-cb29-bbdf-0fea-75240e6d00bc\",\"Operation\":\"OperationTypeApply\",\"Info\":\"\",\"Who\":\"marco.helmich@live.com\",\"Version\":\"0.11.8\",\"Created\":\"2018-09-06T20:08:23.494957724Z\",\"Path\":\"\"}"
+
+	owner := identityFromContext(r.Context())
+	var lockID string
+	err = s.waitForLock(stateID, name, wait, func() error {
+		var err error
+		lockID, err = s.store.LockState(stateID, name, string(body), owner)
+		return err
+	})
+	countConflict(name, err)
+	if errors.Is(err, backend.ErrAlreadyLocked) {
+		logrus.Infof("LOCK: already locked %s %s", name, stateID)
+		writeStoreError(w, err)
+		return
+	} else if err != nil {
+		logrus.Errorf("locking failed [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	// "The final value of ID will be returned by the call to Lock"
+	writeJSON(w, http.StatusOK, &lockResponse{ID: lockID})
+	logrus.Infof("LOCK: %s %s %s", name, stateID, lockID)
+	s.events.publish(&stateEvent{
+		Action:  eventActionLock,
+		Name:    name,
+		StateID: stateID,
+		Who:     owner,
+	})
+}
+
+// getLockInfo returns the lock held on a state
+// a state that isn't locked is a 404
+func (s *httpServer) getLockInfo(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	li, err := s.store.GetLockInfo(stateID, name)
+	if err != nil {
+		logrus.Infof("GET-LOCK: %s %s: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, li)
+}
+
+// verifyLock tells scripts whether the lock in ?ID= still holds the state
+// before they start a long operation, a lock that was force-unlocked underneath them is a 404 or 409
+func (s *httpServer) verifyLock(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lockID := r.URL.Query().Get("ID")
+	if lockID == "" {
+		logrus.Errorf("Can't verify the lock of [%s] [%s] without lock id", name, stateID)
+		writeError(w, http.StatusBadRequest, "Verifying a lock needs the lock ID")
+		return
+	}
+
+	err = s.store.VerifyLock(stateID, name, lockID)
+	if err != nil {
+		logrus.Infof("VERIFY-LOCK: %s %s %s: %s", name, stateID, lockID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &lockResponse{ID: lockID})
+}
+
+// listVersions describes the history of a state without sending the states
+func (s *httpServer) listVersions(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := s.versionsLimit
+	strLimit := r.URL.Query().Get("limit")
+	if strLimit != "" {
+		limit, err = strconv.Atoi(strLimit)
+		if err != nil || limit < 1 {
+			logrus.Errorf("Invalid limit [%s]", strLimit)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Limit needs to be a positive number but is [%s]", strLimit))
+			return
+		}
+	}
+
+	if limit > s.maxVersionsLimit {
+		limit = s.maxVersionsLimit
+	}
+
+	versions, more, err := s.store.ListVersions(stateID, name, limit)
+	if err != nil {
+		logrus.Errorf("Can't list versions of [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	// the body stays a plain list, older versions are only hinted at
+	w.Header().Set("X-More-Versions", strconv.FormatBool(more))
+	writeJSON(w, http.StatusOK, versions)
+	logrus.Infof("LIST-VERSIONS: %s %s %d", name, stateID, len(versions))
+}
+
+// lockResponse tells the client which id the lock it took has
+type lockResponse struct {
+	ID string
+}
+
+// locks are stored as they come in, these limits keep clients
+// from using them to store arbitrary payloads
+const (
+	maxLockInfoBytes       = 4 * 1024
+	maxLockOperationLength = 128
+	maxLockInfoFieldLength = 1024
+)
+
+// readLockInfo reads the lock info out of a request and checks it against the limits
+// bodies that aren't a lock info json are taken as the lock id and only checked for size
+func readLockInfo(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLockInfoBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read request body: %s", err.Error())
+	} else if len(body) > maxLockInfoBytes {
+		return nil, fmt.Errorf("Lock info is longer than %d bytes", maxLockInfoBytes)
+	}
+
+	li := &backend.LockInfo{}
+	if json.Unmarshal(body, li) != nil {
+		return body, nil
+	}
+
+	if utf8.RuneCountInString(li.Operation) > maxLockOperationLength {
+		return nil, fmt.Errorf("Operation is longer than %d characters", maxLockOperationLength)
+	} else if utf8.RuneCountInString(li.Info) > maxLockInfoFieldLength {
+		return nil, fmt.Errorf("Info is longer than %d characters", maxLockInfoFieldLength)
+	}
+
+	return body, nil
+}
+
+// lockAndGetState takes the lock and returns the state it protects in one round trip
+func (s *httpServer) lockAndGetState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if s.refuseWhileDraining(w, name, stateID) || s.refuseLockChurn(w, name, stateID) {
+		return
+	}
+
+	body, err := readLockInfo(r)
+	if err != nil {
+		logrus.Errorf("Invalid lock info for [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wait, err := s.lockWait(r)
+	if err != nil {
+		logrus.Errorf("Invalid lock timeout for [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	owner := identityFromContext(r.Context())
+	var data []byte
+	err = s.waitForLock(stateID, name, wait, func() error {
+		var err error
+		data, err = s.store.LockAndGet(stateID, name, string(body), owner)
+		return err
+	})
+	countConflict(name, err)
+	if errors.Is(err, backend.ErrAlreadyLocked) {
+		logrus.Infof("LOCK-AND-GET: already locked %s %s", name, stateID)
+		writeStoreError(w, err)
+		return
+	} else if err != nil {
+		logrus.Errorf("locking failed [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	logrus.Infof("LOCK-AND-GET: %s %s", name, stateID)
+	s.events.publish(&stateEvent{
+		Action:  eventActionLock,
+		Name:    name,
+		StateID: stateID,
+		Who:     owner,
+	})
+	s.writeStateBody(w, r, name, stateID, data)
+}
+
+// lockWaitTimeoutHeader lets a single LOCK wait longer or shorter than the default
+// it's a go duration like 5m or a number of seconds
+const lockWaitTimeoutHeader = "X-Lock-Timeout"
+
+// lockWait is how long a LOCK waits for a held lock to be released
+func (s *httpServer) lockWait(r *http.Request) (time.Duration, error) {
+	s.lockWaitMutex.RLock()
+	defaultWait := s.lockWaitTimeout
+	maxWait := s.maxLockWaitTimeout
+	s.lockWaitMutex.RUnlock()
+
+	header := r.Header.Get(lockWaitTimeoutHeader)
+	if header == "" {
+		return defaultWait, nil
+	}
+
+	wait, err := time.ParseDuration(header)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(header)
+		if atoiErr != nil {
+			return 0, fmt.Errorf("%s needs to be a duration or a number of seconds but is [%s]", lockWaitTimeoutHeader, header)
+		}
+
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait < 0 {
+		return 0, fmt.Errorf("%s can't be negative but is [%s]", lockWaitTimeoutHeader, header)
+	} else if wait > maxWait {
+		logrus.Infof("Clamping %s of %s to %s", lockWaitTimeoutHeader, wait, maxWait)
+		wait = maxWait
+	}
+
+	return wait, nil
+}
+
+// setLockWaits changes how long LOCKs wait by default and at most
+func (s *httpServer) setLockWaits(defaultWait time.Duration, maxWait time.Duration) {
+	// the default wait is always allowed
+	if maxWait < defaultWait {
+		maxWait = defaultWait
+	}
+
+	s.lockWaitMutex.Lock()
+	defer s.lockWaitMutex.Unlock()
+	s.lockWaitTimeout = defaultWait
+	s.maxLockWaitTimeout = maxWait
+}
+
+// waitForLock calls lock until it doesn't report a held lock anymore
+// or the wait passed
+func (s *httpServer) waitForLock(stateID string, name string, wait time.Duration, lock func() error) error {
+	err := lock()
+	deadline := time.Now().Add(wait)
+	for errors.Is(err, backend.ErrAlreadyLocked) && time.Now().Before(deadline) {
+		// wait for the holder to release the lock and try again
+		err = s.store.WaitForUnlock(stateID, name, time.Until(deadline))
+		if err != nil {
+			return err
+		}
+
+		err = lock()
+	}
+
+	return err
+}
+
+func (s *httpServer) unlockState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	if s.refuseLockChurn(w, name, stateID) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logrus.Errorf("Can't deserialize request body: %s", err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Can't read request body: %s", err.Error()))
+		return
+	}
+
+	// the body now contains only the lock id
+	// not even a json object with the lock id...just the lock id
+	// something like this: 21372f90-cb29-bbdf-0fea-75240e6d00bc
+
+	logrus.Infof("UNLOCK: body %s", string(body))
+
+	err = s.store.UnlockState(stateID, name, string(body))
+	var mismatch *backend.LockMismatchError
+	if errors.As(err, &mismatch) {
+		logrus.Infof("UNLOCK: lock mismatch %s %s: %s", name, stateID, err.Error())
+		writeJSON(w, s.unlockMismatch, &lockMismatchResponse{Error: err.Error(), LockInfo: mismatch.LockInfo})
+		return
+	} else if err != nil {
+		logrus.Errorf("unlocking failed [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	w.WriteHeader(s.writeSuccessStatus)
+	logrus.Infof("UNLOCK: %s %s", name, stateID)
+	s.events.publish(&stateEvent{
+		Action:  eventActionUnlock,
+		Name:    name,
+		StateID: stateID,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+// lockMismatchResponse tells an UNLOCK with the wrong lock id who holds the lock
+// the lock info is missing if the state isn't locked at all
+type lockMismatchResponse struct {
+	Error    string            `json:"error"`
+	LockInfo *backend.LockInfo `json:"lock_info,omitempty"`
+}
+
+func (s *httpServer) forceUnlockState(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	// the lock id the operator expects to break
+	// comes either as query param or as the request body
+	expectedLockID := r.URL.Query().Get("ID")
+	if expectedLockID == "" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logrus.Errorf("Can't read request body: %s", err.Error())
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Can't read request body: %s", err.Error()))
+			return
+		}
+		expectedLockID = string(body)
+	}
+
+	override := r.URL.Query().Get("override") == "true"
+	if expectedLockID == "" && !override {
+		logrus.Errorf("Force unlock of [%s] [%s] without lock id or override", name, stateID)
+		writeError(w, http.StatusBadRequest, "Force unlock needs the id of the lock to break or override=true")
+		return
+	}
+
+	li, err := s.store.ForceUnlock(stateID, name, expectedLockID, override)
+	if errors.Is(err, backend.ErrLockMismatch) {
+		logrus.Infof("FORCE-UNLOCK: lock mismatch %s %s", name, stateID)
+		writeJSON(w, http.StatusConflict, li)
+		return
+	} else if err != nil {
+		logrus.Errorf("force unlocking failed [%s] [%s]: %s", name, stateID, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, li)
+	logrus.Warnf("FORCE-UNLOCK: %s %s %s override: %t", name, stateID, li.ID, override)
+	s.events.publish(&stateEvent{
+		Action:  eventActionUnlock,
+		Name:    name,
+		StateID: stateID,
+		Who:     identityFromContext(r.Context()),
+	})
+}
+
+func (s *httpServer) listLocks(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	locks, err := s.store.ListLocks()
+	if err != nil {
+		logrus.Errorf("Listing locks failed: %s", err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	orphaned, err := s.store.ListOrphanedLocks()
+	if err != nil {
+		logrus.Errorf("Listing orphaned locks failed: %s", err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	orphanedKeys := make(map[backend.StateRef]bool, len(orphaned))
+	for _, lock := range orphaned {
+		orphanedKeys[backend.StateRef{StateID: lock.StateID, Name: lock.Name}] = true
+	}
+
+	for _, lock := range locks {
+		lock.Orphaned = orphanedKeys[backend.StateRef{StateID: lock.StateID, Name: lock.Name}]
+	}
+
+	writeJSON(w, http.StatusOK, locks)
+	logrus.Infof("LIST-LOCKS: %d (%d orphaned)", len(locks), len(orphaned))
+}
+
+func (s *httpServer) listWorkspaces(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := vars["name"]
+	defer r.Body.Close()
+
+	workspaces, err := s.store.ListWorkspaces(name)
+	if err != nil {
+		logrus.Errorf("Listing workspaces of [%s] failed: %s", name, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, workspaces)
+	logrus.Infof("LIST-WORKSPACES: %s %d", name, len(workspaces))
+}
+
+// listNames returns the names of all states that start with the prefix query parameter
+// with a configuration and workspace separator as prefix these are its workspaces
+func (s *httpServer) listNames(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	defer r.Body.Close()
+
+	names, err := s.store.ListNames(prefix)
+	if err != nil {
+		logrus.Errorf("Listing names with prefix [%s] failed: %s", prefix, err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, names)
+	logrus.Infof("LIST-NAMES: %s %d", prefix, len(names))
+}
+
+func (s *httpServer) compact(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	retention := s.compactRetention
+	strRetention := r.URL.Query().Get("retention")
+	if strRetention != "" {
+		var err error
+		retention, err = strconv.Atoi(strRetention)
+		if err != nil || retention < 1 {
+			logrus.Errorf("Invalid retention [%s]", strRetention)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Retention needs to be a positive number but is [%s]", strRetention))
+			return
+		}
+	}
+
+	vacuum := r.URL.Query().Get("vacuum") == "true"
+	results, err := s.store.Compact(retention, vacuum)
+	if err != nil {
+		logrus.Errorf("Compaction failed: %s", err.Error())
+		writeStoreError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+	logrus.Infof("COMPACT: retention %d vacuum %t states %d", retention, vacuum, len(results))
+}
+
+// listFailedRequests returns the captured requests that were answered with a 5xx
+func (s *httpServer) listFailedRequests(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	requests, err := s.capture.list()
+	if err != nil {
+		logrus.Errorf("Can't read failed requests: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, "Can't read failed requests")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, requests)
+}
+
+// drain stops the node from handing out new locks ahead of a shutdown
+// locks that are held can still be released and states read and written
+// so that applies in flight get to finish
+func (s *httpServer) drain() {
+	if atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		logrus.Warn("Draining, new locks are refused until the node is shut down")
+	}
+}
+
+// refuseWhileDraining answers a LOCK with a 503 if the node is draining
+// terraform gives up on the lock and the next attempt lands on another node
+func (s *httpServer) refuseWhileDraining(w http.ResponseWriter, name string, stateID string) bool {
+	if atomic.LoadInt32(&s.draining) == 0 {
+		return false
+	}
+
+	logrus.Infof("LOCK: draining, refusing %s %s", name, stateID)
+	writeError(w, http.StatusServiceUnavailable, "tf-locker is draining for a restart, try again")
+	return true
+}
+
+// refuseLockChurn answers a LOCK or UNLOCK with a 429
+// if the state has been locked and unlocked too often lately
+func (s *httpServer) refuseLockChurn(w http.ResponseWriter, name string, stateID string) bool {
+	ok, retryAfter := s.lockChurn.allow(name, stateID)
+	if ok {
+		return false
+	}
+
+	logrus.Warnf("Too much lock churn on %s %s", name, stateID)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, fmt.Sprintf("[%s] [%s] is locked and unlocked too often, try again later", name, stateID))
+	return true
+}
+
+// errorResponse is the body of failed requests that explain themselves
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *httpServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	err := s.store.CheckHealth()
+	if errors.Is(err, backend.ErrSchemaNotReady) {
+		writeJSON(w, http.StatusServiceUnavailable, &healthStatus{Status: "schema_not_ready", Error: err.Error()})
+		return
+	} else if err != nil {
+		logrus.Errorf("Health check failed: %s", err.Error())
+		writeJSON(w, http.StatusServiceUnavailable, &healthStatus{Status: "db_unreachable", Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &healthStatus{Status: "ok"})
+}
+
+// serviceStatus is what's behind /
+type serviceStatus struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+	DB      string `json:"db"`
+}
+
+// rootStatus tells whoever looks at / that tf-locker is up and which version it is
+// unlike the health check it's always a 200, the database is only pinged
+// the schema checks are left to the health check
+func (s *httpServer) rootStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	db := "ok"
+	if s.store.Ping() != nil {
+		db = "unreachable"
+	}
+
+	writeJSON(w, http.StatusOK, &serviceStatus{Service: "tf-locker", Version: version, DB: db})
+}
+
+// registerDefaultNameRoutes serves states of the default name without a name segment
+// for terraform backend configs whose address ends in the state id
+// the state id needs to match the id format, that way /state/{state_id}/lock
+// isn't mistaken for a state called lock and vice versa
+// with any-safe ids that's no longer true and the default name wins
+// these go before all other routes
+func (s *httpServer) registerDefaultNameRoutes(router *mux.Router, cfg httpServerConfig) {
+	path := "/state/{state_id:" + s.idFormat.pattern + "}"
+
+	router.
+		Methods("GET").
+		Path(path).
+		HandlerFunc(s.getState).
+		Name("getDefaultState")
+
+	router.
+		Methods("HEAD").
+		Path(path).
+		HandlerFunc(s.stateExists).
+		Name("headDefaultState")
+
+	router.
+		Methods("POST", "PUT").
+		Path(path).
+		HandlerFunc(s.setState).
+		Name("setDefaultState")
+
+	router.
+		Methods("DELETE").
+		Path(path).
+		HandlerFunc(s.deleteState).
+		Name("deleteDefaultState")
+
+	router.
+		Methods(cfg.lockMethod).
+		Path(path).
+		HandlerFunc(s.lockState).
+		Name("lockDefaultState")
+
+	router.
+		Methods(cfg.unlockMethod).
+		Path(path).
+		HandlerFunc(s.unlockState).
+		Name("unlockDefaultState")
+
+	router.
+		Methods("POST").
+		Path(path + "/lock").
+		HandlerFunc(s.lockState).
+		Name("lockDefaultStatePost")
+
+	router.
+		Methods("POST").
+		Path(path + "/unlock").
+		HandlerFunc(s.unlockState).
+		Name("unlockDefaultStatePost")
+
+	router.
+		Methods("GET").
+		Path(path + "/lock").
+		HandlerFunc(s.getLockInfo).
+		Name("getDefaultLockInfo")
+
+	router.
+		Methods("GET").
+		Path(path + "/lock/verify").
+		HandlerFunc(s.verifyLock).
+		Name("verifyDefaultLock")
+
+	router.
+		Methods("GET").
+		Path(path + "/versions").
+		HandlerFunc(s.listVersions).
+		Name("listDefaultVersions")
+
+	router.
+		Methods("POST").
+		Path(path + "/commit").
+		HandlerFunc(s.commitState).
+		Name("commitDefaultState")
+
+	router.
+		Methods("POST").
+		Path(path + "/force-unlock").
+		HandlerFunc(s.forceUnlockState).
+		Name("forceUnlockDefaultState")
+
+	router.
+		Methods("POST").
+		Path(path + "/lock-and-get").
+		HandlerFunc(s.lockAndGetState).
+		Name("lockAndGetDefaultState")
+
+	router.
+		Methods("POST").
+		Path(path + "/undelete").
+		HandlerFunc(s.undeleteState).
+		Name("undeleteDefaultState")
+
+	router.
+		Methods("POST").
+		Path(path + "/copy").
+		HandlerFunc(s.copyState).
+		Name("copyDefaultState")
+
+	if s.signer != nil {
+		router.
+			Methods("POST").
+			Path(path + "/signed-url").
+			HandlerFunc(s.createSignedURL).
+			Name("createDefaultSignedURL")
+	}
+}
+
+// registerWorkspaceRoutes serves the same operations as the named routes
+// for a workspace of a configuration
+func (s *httpServer) registerWorkspaceRoutes(router *mux.Router, cfg httpServerConfig) {
+	path := "/state/{name}/{workspace}/{state_id}"
+
+	router.
+		Methods("GET").
+		Path(path).
+		HandlerFunc(s.getState).
+		Name("getWorkspaceState")
+
+	router.
+		Methods("HEAD").
+		Path(path).
+		HandlerFunc(s.stateExists).
+		Name("headWorkspaceState")
+
+	router.
+		Methods("GET").
+		Path(path + "/exists").
+		HandlerFunc(s.stateExists).
+		Name("workspaceStateExists")
+
+	router.
+		Methods("POST", "PUT").
+		Path(path).
+		HandlerFunc(s.setState).
+		Name("setWorkspaceState")
+
+	router.
+		Methods("DELETE").
+		Path(path).
+		HandlerFunc(s.deleteState).
+		Name("deleteWorkspaceState")
+
+	router.
+		Methods(cfg.lockMethod).
+		Path(path).
+		HandlerFunc(s.lockState).
+		Name("lockWorkspaceState")
+
+	router.
+		Methods(cfg.unlockMethod).
+		Path(path).
+		HandlerFunc(s.unlockState).
+		Name("unlockWorkspaceState")
+
+	router.
+		Methods("POST").
+		Path(path + "/lock").
+		HandlerFunc(s.lockState).
+		Name("lockWorkspaceStatePost")
+
+	router.
+		Methods("POST").
+		Path(path + "/unlock").
+		HandlerFunc(s.unlockState).
+		Name("unlockWorkspaceStatePost")
+
+	router.
+		Methods("GET").
+		Path(path + "/lock").
+		HandlerFunc(s.getLockInfo).
+		Name("getWorkspaceLockInfo")
+
+	router.
+		Methods("GET").
+		Path(path + "/lock/verify").
+		HandlerFunc(s.verifyLock).
+		Name("verifyWorkspaceLock")
+
+	router.
+		Methods("GET").
+		Path(path + "/versions").
+		HandlerFunc(s.listVersions).
+		Name("listWorkspaceVersions")
+
+	router.
+		Methods("POST").
+		Path(path + "/commit").
+		HandlerFunc(s.commitState).
+		Name("commitWorkspaceState")
+
+	router.
+		Methods("POST").
+		Path(path + "/force-unlock").
+		HandlerFunc(s.forceUnlockState).
+		Name("forceUnlockWorkspaceState")
+
+	router.
+		Methods("POST").
+		Path(path + "/lock-and-get").
+		HandlerFunc(s.lockAndGetState).
+		Name("lockAndGetWorkspaceState")
+
+	router.
+		Methods("POST").
+		Path(path + "/undelete").
+		HandlerFunc(s.undeleteState).
+		Name("undeleteWorkspaceState")
+
+	router.
+		Methods("POST").
+		Path(path + "/copy").
+		HandlerFunc(s.copyState).
+		Name("copyWorkspaceState")
+
+	if s.signer != nil {
+		router.
+			Methods("POST").
+			Path(path + "/signed-url").
+			HandlerFunc(s.createSignedURL).
+			Name("createWorkspaceSignedURL")
+	}
+}
+
+// stateName is the name a state is stored under
+// routes with a workspace segment address that workspace of the configuration
+// routes without a name segment address the default name
+func (s *httpServer) stateName(vars map[string]string) string {
+	return backend.WorkspaceStateName(s.configName(vars), vars["workspace"])
+}
+
+// configName is the name of the configuration a request addresses without its workspace
+func (s *httpServer) configName(vars map[string]string) string {
+	name, ok := vars["name"]
+	if !ok {
+		name = s.defaultStateName
+	}
+
+	return name
+}
+
+// pathVars returns the decoded route variables of a request
+// the router matches on the encoded path and hands them out encoded
+func pathVars(r *http.Request) map[string]string {
+	vars := mux.Vars(r)
+	decoded := make(map[string]string, len(vars))
+	for key, value := range vars {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			unescaped = value
+		}
+
+		decoded[key] = unescaped
+	}
+
+	return decoded
+}
+
+func (s *httpServer) validateIDs(configName string, workspace string, id string) error {
+	err := s.idFormat.validate(id)
+	if err != nil {
+		return err
+	}
+
+	// otherwise /state/a:b/{id} and workspace b of /state/a/{id} would be the same state
+	if strings.Contains(configName, backend.WorkspaceSeparator) || strings.Contains(workspace, backend.WorkspaceSeparator) {
+		return fmt.Errorf("Names and workspaces can't contain %s: %q %q", backend.WorkspaceSeparator, configName, workspace)
+	}
+
+	name := backend.WorkspaceStateName(configName, workspace)
+
+	// the name column is a VARCHAR(64) which counts characters not bytes
+	if utf8.RuneCountInString(name) > 64 {
+		return fmt.Errorf("String too long (> 64): %s", name)
+	}
+
+	// postgres refuses invalid utf-8 and NUL bytes in text
+	// control characters would only cause trouble in logs and urls
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("Name isn't valid utf-8: %q", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Name contains control characters: %q", name)
+		}
+	}
+
+	if s.namePattern != nil && !s.namePattern.MatchString(name) {
+		return fmt.Errorf("Name [%s] doesn't follow the naming convention, it needs to match %s", name, s.namePattern.String())
+	}
+
+	return nil
+}
+
+// errorStatus maps errors coming out of the store to http status codes
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, backend.ErrAlreadyLocked):
+		return http.StatusLocked
+	case errors.Is(err, backend.ErrLockMismatch), errors.Is(err, backend.ErrVersionConflict), errors.Is(err, backend.ErrNotDeleted), errors.Is(err, backend.ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, backend.ErrNotLocked), errors.Is(err, backend.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, backend.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, backend.ErrLockRequired):
+		return http.StatusPreconditionRequired
+	case errors.Is(err, backend.ErrReadOnly), errors.Is(err, backend.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError explains a failed request to the client
+// terraform shows the body of failed requests to its user
+// checkLockMethods refuses lock and unlock methods the state routes already answer
+// a LOCK_METHOD=POST would never reach lockState, terraforms lock request would be stored as the state
+func checkLockMethods(lockMethod string, unlockMethod string) error {
+	if lockMethod == "" || unlockMethod == "" {
+		return fmt.Errorf("Lock and unlock methods can't be empty")
+	} else if strings.EqualFold(lockMethod, unlockMethod) {
+		return fmt.Errorf("Lock and unlock methods need to differ but both are %s", lockMethod)
+	}
+
+	for _, method := range []string{lockMethod, unlockMethod} {
+		switch strings.ToUpper(method) {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+			return fmt.Errorf("Lock and unlock methods can't be %s, that's taken by the state itself; "+
+				"point terraforms lock_address/unlock_address at the POST routes under /lock and /unlock instead", method)
+		}
+	}
+
+	return nil
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &errorResponse{Error: message})
+}
+
+// writeStoreError answers with the status that goes with a store error
+// unexpected errors are only described in the log, they can carry database internals
+// a lock conflict answers with the holders LockInfo, that's what terraform expects in a 423
+func writeStoreError(w http.ResponseWriter, err error) {
+	var locked *backend.LockedError
+	if errors.As(err, &locked) {
+		writeJSON(w, http.StatusLocked, locked.LockInfo)
+		return
+	}
+
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		writeError(w, status, "Internal error, the tf-locker logs have the details")
+		return
+	}
+
+	writeError(w, status, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bites, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("Can't serialize response: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bites)
+}
+
+func md5Hash(data []byte) string {
+	hash := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerDeadlineListener puts a read deadline on every connection it accepts
+// proxyproto reads the header without one before net/http sets its own
+type headerDeadlineListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *headerDeadlineListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if l.timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+
+	return conn, nil
 }
@@ -0,0 +1,739 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mhelmich/tf-locker/backend"
+)
+
+const testState = `{"version":4,"serial":1,"lineage":"2b6e1d2a-5a3c-4f7e-8e5b-0c1d2e3f4a5b"}`
+
+// testServer runs the real router against an in-memory store
+type testServer struct {
+	*httptest.Server
+	server *httpServer
+	store  backend.Store
+}
+
+// testConfig is what main configures without any environment
+func testConfig() httpServerConfig {
+	return httpServerConfig{
+		lockMethod:           "LOCK",
+		unlockMethod:         "UNLOCK",
+		healthPath:           "/healthz",
+		metricsPath:          "/metrics",
+		compression:          compressionNone,
+		writeSuccessStatus:   http.StatusOK,
+		compactRetention:     10,
+		versionsLimit:        100,
+		maxVersionsLimit:     1000,
+		idFormat:             idFormatUUID,
+		unlockMismatchStatus: http.StatusForbidden,
+	}
+}
+
+func startTestServer(t *testing.T, cfg httpServerConfig) *testServer {
+	return startTestServerWithStore(t, cfg, backend.NewMemoryStore())
+}
+
+func startTestServerWithStore(t *testing.T, cfg httpServerConfig, store backend.Store) *testServer {
+	// port 0 lets startNewHTTPServer listen wherever, the tests go through httptest
+	server, err := startNewHTTPServer(cfg, store)
+	if err != nil {
+		t.Fatalf("Can't start http server: %s", err.Error())
+	}
+
+	return &testServer{
+		Server: httptest.NewServer(server.Handler),
+		server: server,
+		store:  store,
+	}
+}
+
+func (ts *testServer) close() {
+	ts.Server.Close()
+	ts.server.Close()
+}
+
+// request sends body to path and returns the response with its body read
+func (ts *testServer) request(t *testing.T, method string, path string, body string) (*http.Response, []byte) {
+	return ts.requestWithBody(t, method, path, strings.NewReader(body))
+}
+
+func (ts *testServer) requestWithBody(t *testing.T, method string, path string, body io.Reader) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatalf("Can't create %s %s: %s", method, path, err.Error())
+	}
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err.Error())
+	}
+	defer resp.Body.Close()
+
+	bites, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Can't read response of %s %s: %s", method, path, err.Error())
+	}
+
+	return resp, bites
+}
+
+func expectStatus(t *testing.T, method string, path string, resp *http.Response, body []byte, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s answered %d, want %d: %s", method, path, resp.StatusCode, status, string(body))
+	}
+}
+
+// testLockInfo is the lock info terraform sends with a LOCK
+func testLockInfo(t *testing.T, id string, who string) string {
+	bites, err := json.Marshal(&backend.LockInfo{
+		ID:        id,
+		Operation: "OperationTypeApply",
+		Who:       who,
+		Version:   "0.12.29",
+		Created:   time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatalf("Can't serialize lock info: %s", err.Error())
+	}
+
+	return string(bites)
+}
+
+func testStatePath() string {
+	return "/state/tf/" + uuid.New().String()
+}
+
+func TestStateLifecycle(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	lockID := uuid.New().String()
+
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, lockID, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+	lr := &lockResponse{}
+	if err := json.Unmarshal(body, lr); err != nil || lr.ID != lockID {
+		t.Fatalf("LOCK answered %s, want lock id %s", string(body), lockID)
+	}
+
+	resp, body = ts.request(t, "POST", path+"?ID="+lockID, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if string(body) != testState {
+		t.Fatalf("GET answered %s, want %s", string(body), testState)
+	}
+
+	resp, body = ts.request(t, "UNLOCK", path, lockID)
+	expectStatus(t, "UNLOCK", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "DELETE", path, "")
+	expectStatus(t, "DELETE", path, resp, body, http.StatusOK)
+
+	// terraform takes an empty state for one that doesn't exist
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if len(body) != 0 {
+		t.Fatalf("GET of a deleted state answered %s", string(body))
+	}
+}
+
+func TestLockConflict(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	holder := uuid.New().String()
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, holder, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "LOCK", path, testLockInfo(t, uuid.New().String(), "bob"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusLocked)
+	li := &backend.LockInfo{}
+	if err := json.Unmarshal(body, li); err != nil || li.ID != holder || li.Who != "alice" {
+		t.Fatalf("423 carries %s, want the lock of alice with id %s", string(body), holder)
+	}
+
+	// writes without the lock id don't get past the lock either
+	resp, body = ts.request(t, "POST", path, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusLocked)
+}
+
+func TestInvalidIDs(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	cases := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/state/tf/not-a-uuid"},
+		{"POST", "/state/tf/not-a-uuid"},
+		{"DELETE", "/state/tf/not-a-uuid"},
+		{"LOCK", "/state/tf/not-a-uuid"},
+		{"UNLOCK", "/state/tf/not-a-uuid"},
+		{"GET", "/state/" + strings.Repeat("n", 65) + "/" + stateID},
+		{"POST", "/state/" + strings.Repeat("n", 65) + "/" + stateID},
+		{"GET", "/state/tf%01/" + stateID},
+	}
+
+	for _, c := range cases {
+		resp, body := ts.request(t, c.method, c.path, testLockInfo(t, uuid.New().String(), "alice"))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s answered %d, want %d: %s", c.method, c.path, resp.StatusCode, http.StatusBadRequest, string(body))
+		}
+	}
+}
+
+func TestContentMD5(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	resp, body := ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if got := resp.Header.Get("Content-MD5"); got != "" {
+		t.Fatalf("GET of an empty state has Content-MD5 %s", got)
+	}
+
+	resp, body = ts.request(t, "POST", path, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	// terraform checks the body it got against this
+	hash := md5.Sum([]byte(testState))
+	want := base64.StdEncoding.EncodeToString(hash[:])
+	if got := resp.Header.Get("Content-MD5"); got != want {
+		t.Fatalf("Content-MD5 is %s, want %s", got, want)
+	}
+}
+
+func TestDoubleUnlock(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	lockID := uuid.New().String()
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, lockID, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "UNLOCK", path, lockID)
+	expectStatus(t, "UNLOCK", path, resp, body, http.StatusOK)
+
+	// terraform retries an UNLOCK whose response got lost
+	resp, body = ts.request(t, "UNLOCK", path, lockID)
+	expectStatus(t, "UNLOCK", path, resp, body, http.StatusOK)
+
+	// the retry didn't take anything with it
+	resp, body = ts.request(t, "LOCK", path, testLockInfo(t, uuid.New().String(), "bob"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+}
+
+func TestUnlockWithWrongID(t *testing.T) {
+	cfg := testConfig()
+	cfg.unlockMismatchStatus = http.StatusConflict
+	ts := startTestServer(t, cfg)
+	defer ts.close()
+
+	path := testStatePath()
+	holder := uuid.New().String()
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, holder, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "UNLOCK", path, uuid.New().String())
+	expectStatus(t, "UNLOCK", path, resp, body, cfg.unlockMismatchStatus)
+	mismatch := &lockMismatchResponse{}
+	if err := json.Unmarshal(body, mismatch); err != nil || mismatch.LockInfo == nil || mismatch.LockInfo.ID != holder {
+		t.Fatalf("UNLOCK with the wrong id answered %s, want the lock of %s", string(body), holder)
+	}
+
+	// the lock is still held
+	resp, body = ts.request(t, "LOCK", path, testLockInfo(t, uuid.New().String(), "bob"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusLocked)
+}
+
+func TestConcurrentLockOfNewState(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	// a new state every round, the race is about creating it with the lock
+	for round := 0; round < 20; round++ {
+		path := testStatePath()
+		lockIDs := []string{uuid.New().String(), uuid.New().String()}
+		lockInfos := []string{testLockInfo(t, lockIDs[0], "alice"), testLockInfo(t, lockIDs[1], "bob")}
+		statuses := make([]int, len(lockIDs))
+		bodies := make([][]byte, len(lockIDs))
+		errs := make([]error, len(lockIDs))
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := range lockIDs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req, err := http.NewRequest("LOCK", ts.URL+path, strings.NewReader(lockInfos[i]))
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				<-start
+				resp, err := ts.Client().Do(req)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer resp.Body.Close()
+
+				statuses[i] = resp.StatusCode
+				bodies[i], errs[i] = ioutil.ReadAll(resp.Body)
+			}(i)
+		}
+
+		close(start)
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatalf("LOCK %s failed: %s", path, err.Error())
+			}
+		}
+
+		winner, loser := 0, 1
+		if statuses[1] == http.StatusOK {
+			winner, loser = 1, 0
+		}
+
+		if statuses[winner] != http.StatusOK || statuses[loser] != http.StatusLocked {
+			t.Fatalf("Concurrent LOCKs answered %d and %d, want one %d and one %d", statuses[0], statuses[1], http.StatusOK, http.StatusLocked)
+		}
+
+		li := &backend.LockInfo{}
+		if err := json.Unmarshal(bodies[loser], li); err != nil || li.ID != lockIDs[winner] {
+			t.Fatalf("423 carries %s, want the lock of the winner %s", string(bodies[loser]), lockIDs[winner])
+		}
+	}
+}
+
+func TestDeleteLockedState(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	lockID := uuid.New().String()
+	resp, body := ts.request(t, "POST", path, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+	resp, body = ts.request(t, "LOCK", path, testLockInfo(t, lockID, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+
+	for _, query := range []string{"", "?ID=" + uuid.New().String()} {
+		resp, body = ts.request(t, "DELETE", path+query, "")
+		expectStatus(t, "DELETE", path+query, resp, body, http.StatusLocked)
+		li := &backend.LockInfo{}
+		if err := json.Unmarshal(body, li); err != nil || li.ID != lockID {
+			t.Fatalf("423 carries %s, want the lock %s", string(body), lockID)
+		}
+
+		resp, body = ts.request(t, "GET", path, "")
+		expectStatus(t, "GET", path, resp, body, http.StatusOK)
+		if string(body) != testState {
+			t.Fatalf("GET after the refused DELETE%s answered %s, want %s", query, string(body), testState)
+		}
+	}
+
+	// the holder can delete it
+	resp, body = ts.request(t, "DELETE", path+"?ID="+lockID, "")
+	expectStatus(t, "DELETE", path, resp, body, http.StatusOK)
+}
+
+func TestSlashedNames(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	encoded := "/state/team%2Fproject/" + stateID
+	resp, body := ts.request(t, "POST", encoded, testState)
+	expectStatus(t, "POST", encoded, resp, body, http.StatusCreated)
+
+	// an encoded slash stays in the name segment and is decoded for the store
+	data, err := ts.store.GetState(stateID, "team/project")
+	if err != nil || string(data) != testState {
+		t.Fatalf("State of team/project is %s (%v), want %s", string(data), err, testState)
+	}
+
+	resp, body = ts.request(t, "GET", encoded, "")
+	expectStatus(t, "GET", encoded, resp, body, http.StatusOK)
+	if string(body) != testState {
+		t.Fatalf("GET %s answered %s, want %s", encoded, string(body), testState)
+	}
+
+	// a literal slash starts the workspace segment, that's a different state
+	literal := "/state/team/project/" + stateID
+	resp, body = ts.request(t, "POST", literal, `{"version":4,"serial":2}`)
+	expectStatus(t, "POST", literal, resp, body, http.StatusCreated)
+	data, err = ts.store.GetState(stateID, backend.WorkspaceStateName("team", "project"))
+	if err != nil || string(data) != `{"version":4,"serial":2}` {
+		t.Fatalf("State of workspace project of team is %s (%v)", string(data), err)
+	}
+
+	resp, body = ts.request(t, "GET", encoded, "")
+	expectStatus(t, "GET", encoded, resp, body, http.StatusOK)
+	if string(body) != testState {
+		t.Fatalf("Writing %s changed %s to %s", literal, encoded, string(body))
+	}
+
+	// names can't have more than one literal slash
+	nested := "/state/org/team/project/" + stateID
+	resp, body = ts.request(t, "GET", nested, "")
+	expectStatus(t, "GET", nested, resp, body, http.StatusNotFound)
+}
+
+// failingReader hands out part of a state and then breaks like a dropped upload
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("connection reset by peer")
+	}
+
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestBrokenUpload(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	path := "/state/tf/" + stateID
+	// the router is called directly, a real client gives up on the request before it gets here
+	req := httptest.NewRequest("POST", path, &failingReader{data: []byte(testState[:20])})
+	rec := httptest.NewRecorder()
+	ts.server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST with a broken body answered %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body.String())
+	}
+
+	exists, err := ts.store.StateExists(stateID, "tf")
+	if err != nil || exists {
+		t.Fatalf("Broken upload was stored (%v)", err)
+	}
+
+	// not even an empty version
+	resp, body := ts.request(t, "GET", path+"/versions", "")
+	expectStatus(t, "GET", path+"/versions", resp, body, http.StatusNotFound)
+}
+
+// brokenUnlockStore fails every UNLOCK like a database that went away
+type brokenUnlockStore struct {
+	backend.Store
+}
+
+func (bus *brokenUnlockStore) UnlockState(stateID string, name string, lockID string) error {
+	return errors.New("pq: connection refused")
+}
+
+func TestUnlockMismatchIsNotAServerError(t *testing.T) {
+	broken := startTestServerWithStore(t, testConfig(), &brokenUnlockStore{Store: backend.NewMemoryStore()})
+	defer broken.close()
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	for _, server := range []*testServer{broken, ts} {
+		resp, body := server.request(t, "LOCK", path, testLockInfo(t, uuid.New().String(), "alice"))
+		expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+	}
+
+	// the database internals stay in the log
+	resp, body := broken.request(t, "UNLOCK", path, uuid.New().String())
+	expectStatus(t, "UNLOCK", path, resp, body, http.StatusInternalServerError)
+	if strings.Contains(string(body), "pq:") {
+		t.Fatalf("500 leaks the database error: %s", string(body))
+	}
+
+	resp, body = ts.request(t, "UNLOCK", path, uuid.New().String())
+	expectStatus(t, "UNLOCK", path, resp, body, testConfig().unlockMismatchStatus)
+}
+
+func TestCreatedStatus(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNoContent} {
+		cfg := testConfig()
+		cfg.writeSuccessStatus = status
+		ts := startTestServer(t, cfg)
+		defer ts.close()
+
+		path := testStatePath()
+		resp, body := ts.request(t, "POST", path, testState)
+		expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+		resp, body = ts.request(t, "POST", path, `{"version":4,"serial":2}`)
+		expectStatus(t, "POST", path, resp, body, status)
+
+		resp, body = ts.request(t, "POST", path, `{"version":4,"serial":3}`)
+		expectStatus(t, "POST", path, resp, body, status)
+
+		// a deleted state is created again by the next write
+		resp, body = ts.request(t, "DELETE", path, "")
+		expectStatus(t, "DELETE", path, resp, body, status)
+		resp, body = ts.request(t, "POST", path, testState)
+		expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+	}
+}
+
+// a signed url only stands in for credentials when reading the state it was signed for
+func TestSignedURLTokenIsNotCredentials(t *testing.T) {
+	cfg := testConfig()
+	cfg.auth = &basicAuthenticator{passwords: map[string]string{"alice": "secret"}}
+	cfg.signedURLSecret = "signing-secret"
+	cfg.signedURLTTL = time.Minute
+	ts := startTestServer(t, cfg)
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	path := "/state/tf/" + stateID
+	_, err := ts.store.UpsertState(stateID, "tf", "", []byte(testState), "")
+	if err != nil {
+		t.Fatalf("Can't write state: %s", err.Error())
+	}
+
+	token, err := ts.server.signer.sign(&signedToken{
+		Name:    "tf",
+		StateID: stateID,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(time.Minute).Unix(),
+		Issuer:  "alice",
+	})
+	if err != nil {
+		t.Fatalf("Can't sign token: %s", err.Error())
+	}
+
+	for _, bogus := range []string{"garbage", token} {
+		resp, body := ts.request(t, "POST", path+"?token="+bogus, `{"version":4,"serial":2}`)
+		expectStatus(t, "POST", path, resp, body, http.StatusUnauthorized)
+
+		resp, body = ts.request(t, "LOCK", path+"?token="+bogus, testLockInfo(t, uuid.New().String(), "mallory"))
+		expectStatus(t, "LOCK", path, resp, body, http.StatusUnauthorized)
+
+		resp, body = ts.request(t, "DELETE", path+"?force=true&token="+bogus, "")
+		expectStatus(t, "DELETE", path, resp, body, http.StatusUnauthorized)
+	}
+
+	resp, body := ts.request(t, "GET", path+"?token=garbage", "")
+	expectStatus(t, "GET", path, resp, body, http.StatusUnauthorized)
+
+	resp, body = ts.request(t, "GET", path+"?token="+token, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if string(body) != testState {
+		t.Fatalf("GET with a signed url answered %s, want %s", string(body), testState)
+	}
+}
+
+// a token that doesn't verify doesn't get around the policy of the state
+func TestSignedURLTokenIsNotPermission(t *testing.T) {
+	p, err := loadPolicy("", `[{"principal":"alice","names":["sandbox"]}]`)
+	if err != nil {
+		t.Fatalf("Can't load policy: %s", err.Error())
+	}
+
+	cfg := testConfig()
+	cfg.auth = &basicAuthenticator{passwords: map[string]string{"alice": "secret"}}
+	cfg.policy = p
+	cfg.signedURLSecret = "signing-secret"
+	cfg.signedURLTTL = time.Minute
+	ts := startTestServer(t, cfg)
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	path := "/state/prod/" + stateID
+	for _, method := range []string{"POST", "LOCK", "DELETE", "GET"} {
+		req, err := http.NewRequest(method, ts.URL+path+"?token=garbage", strings.NewReader(testState))
+		if err != nil {
+			t.Fatalf("Can't create %s %s: %s", method, path, err.Error())
+		}
+
+		req.SetBasicAuth("alice", "secret")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %s", method, path, err.Error())
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s %s with a bogus token answered %d, want %d", method, path, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	exists, err := ts.store.StateExists(stateID, "prod")
+	if err != nil || exists {
+		t.Fatalf("State behind the policy was written: exists %t, %v", exists, err)
+	}
+}
+
+// lock methods the state routes already answer would write the lock info as the state
+func TestLockMethods(t *testing.T) {
+	for _, methods := range [][2]string{
+		{"POST", "UNLOCK"},
+		{"LOCK", "PUT"},
+		{"get", "UNLOCK"},
+		{"LOCK", "DELETE"},
+		{"LOCK", "LOCK"},
+		{"", "UNLOCK"},
+	} {
+		cfg := testConfig()
+		cfg.lockMethod = methods[0]
+		cfg.unlockMethod = methods[1]
+		server, err := startNewHTTPServer(cfg, backend.NewMemoryStore())
+		if err == nil {
+			server.Close()
+			t.Fatalf("Lock method %s and unlock method %s were accepted", methods[0], methods[1])
+		}
+	}
+
+	cfg := testConfig()
+	cfg.lockMethod = "PATCH"
+	cfg.unlockMethod = "PURGE"
+	ts := startTestServer(t, cfg)
+	defer ts.close()
+
+	path := testStatePath()
+	lockID := uuid.New().String()
+	resp, body := ts.request(t, "PATCH", path, testLockInfo(t, lockID, "alice"))
+	expectStatus(t, "PATCH", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if len(body) != 0 {
+		t.Fatalf("Locking wrote the state: %s", string(body))
+	}
+
+	resp, body = ts.request(t, "PURGE", path, lockID)
+	expectStatus(t, "PURGE", path, resp, body, http.StatusOK)
+}
+
+// the separator of workspaces can't be part of a name or workspace
+// otherwise /state/a:b/{id} would be workspace b of /state/a/{id}
+func TestWorkspaceSeparatorInNames(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	stateID := uuid.New().String()
+	for _, path := range []string{
+		"/state/a:b/" + stateID,
+		"/state/a%3Ab/" + stateID,
+		"/state/a/b:c/" + stateID,
+		"/state/a:b/c/" + stateID,
+	} {
+		resp, body := ts.request(t, "POST", path, testState)
+		expectStatus(t, "POST", path, resp, body, http.StatusBadRequest)
+
+		resp, body = ts.request(t, "LOCK", path, testLockInfo(t, uuid.New().String(), "alice"))
+		expectStatus(t, "LOCK", path, resp, body, http.StatusBadRequest)
+	}
+
+	path := "/state/a/b/" + stateID
+	resp, body := ts.request(t, "POST", path, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+	// a stored workspace name is still fine where names come in a body
+	resp, body = ts.request(t, "POST", path+"/copy", `{"name":"a:c","state_id":"`+stateID+`"}`)
+	if resp.StatusCode >= 300 {
+		t.Fatalf("Copy to a workspace answered %d: %s", resp.StatusCode, string(body))
+	}
+
+	resp, body = ts.request(t, "POST", path+"/copy", `{"name":"a:c:d","state_id":"`+stateID+`"}`)
+	expectStatus(t, "POST", "/copy", resp, body, http.StatusBadRequest)
+}
+
+// a DELETE carrying the lock id of the holder goes through like a write would
+func TestDeleteWithLockID(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	lockID := uuid.New().String()
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, lockID, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+	resp, body = ts.request(t, "POST", path+"?ID="+lockID, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+	resp, body = ts.request(t, "DELETE", path+"?ID="+lockID, "")
+	expectStatus(t, "DELETE", path, resp, body, http.StatusOK)
+
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if len(body) != 0 {
+		t.Fatalf("GET after the DELETE answered %s", string(body))
+	}
+}
+
+// a DELETE while somebody else holds the lock is refused with their lock
+// and leaves both the state and the lock alone
+func TestDeleteLockedByAnotherHolder(t *testing.T) {
+	ts := startTestServer(t, testConfig())
+	defer ts.close()
+
+	path := testStatePath()
+	aliceID := uuid.New().String()
+	resp, body := ts.request(t, "LOCK", path, testLockInfo(t, aliceID, "alice"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusOK)
+	resp, body = ts.request(t, "POST", path+"?ID="+aliceID, testState)
+	expectStatus(t, "POST", path, resp, body, http.StatusCreated)
+
+	bobID := uuid.New().String()
+	resp, body = ts.request(t, "DELETE", path+"?ID="+bobID, "")
+	expectStatus(t, "DELETE", path, resp, body, http.StatusLocked)
+	li := &backend.LockInfo{}
+	if err := json.Unmarshal(body, li); err != nil || li.ID != aliceID || li.Who != "alice" {
+		t.Fatalf("423 carries %s, want the lock of alice %s", string(body), aliceID)
+	}
+
+	resp, body = ts.request(t, "GET", path, "")
+	expectStatus(t, "GET", path, resp, body, http.StatusOK)
+	if string(body) != testState {
+		t.Fatalf("GET after the refused DELETE answered %s, want %s", string(body), testState)
+	}
+
+	// alice still holds the lock and can go on writing
+	resp, body = ts.request(t, "POST", path+"?ID="+aliceID, `{"version":4,"serial":2}`)
+	expectStatus(t, "POST", path, resp, body, http.StatusOK)
+	resp, body = ts.request(t, "LOCK", path, testLockInfo(t, bobID, "bob"))
+	expectStatus(t, "LOCK", path, resp, body, http.StatusLocked)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+const (
+	idFormatUUID    = "uuid"
+	idFormatULID    = "ulid"
+	idFormatAnySafe = "any-safe"
+)
+
+const (
+	// crockford base32, the first character keeps the timestamp within 48 bits
+	ulidPattern = "[0-7][0-9A-HJKMNP-TV-Za-hjkmnp-tv-z]{25}"
+	// characters that never need escaping in a url path
+	safeIDPattern = "[A-Za-z0-9._~-]{1,128}"
+)
+
+// idFormat decides which state ids are accepted
+type idFormat struct {
+	name string
+	// state ids in routes look like this
+	pattern  string
+	validate func(id string) error
+}
+
+func newIDFormat(name string) (*idFormat, error) {
+	switch name {
+	case idFormatUUID:
+		return &idFormat{
+			name:    name,
+			pattern: uuidPattern,
+			validate: func(id string) error {
+				_, err := uuid.Parse(id)
+				if err != nil {
+					return fmt.Errorf("Can't parse uuid [%s]: %s", id, err.Error())
+				}
+
+				return nil
+			},
+		}, nil
+	case idFormatULID:
+		return newPatternIDFormat(name, ulidPattern, "a ulid"), nil
+	case idFormatAnySafe:
+		return newPatternIDFormat(name, safeIDPattern, "1 to 128 letters, digits, '.', '_', '~' or '-'"), nil
+	default:
+		return nil, fmt.Errorf("Unknown id format [%s], valid are %s, %s and %s", name, idFormatUUID, idFormatULID, idFormatAnySafe)
+	}
+}
+
+func newPatternIDFormat(name string, pattern string, description string) *idFormat {
+	re := regexp.MustCompile("^" + pattern + "$")
+	return &idFormat{
+		name:    name,
+		pattern: pattern,
+		validate: func(id string) error {
+			if !re.MatchString(id) {
+				return fmt.Errorf("State id [%s] needs to be %s", id, description)
+			}
+
+			return nil
+		},
+	}
+}
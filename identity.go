@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey string
+
+const (
+	identityContextKey  contextKey = "identity"
+	clientIPContextKey  contextKey = "client_ip"
+	terraformUserHeader            = "X-Terraform-User"
+	forwardedForHeader             = "X-Forwarded-For"
+	realIPHeader                   = "X-Real-IP"
+)
+
+// clientIdentity figures out who is making a request
+// whoever the authenticator accepted wins over a verified client certificate
+// which wins over basic auth
+// which wins over the self-reported X-Terraform-User header
+func clientIdentity(r *http.Request) string {
+	if identity := authenticatedIdentity(r); identity != "" {
+		return identity
+	}
+
+	return r.Header.Get(terraformUserHeader)
+}
+
+// authenticatedIdentity is the identity of a client that authenticated itself
+// it's empty for clients that only say who they are in X-Terraform-User
+func authenticatedIdentity(r *http.Request) string {
+	if identity, _ := r.Context().Value(authenticatedContextKey).(string); identity != "" {
+		return identity
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+
+	return ""
+}
+
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey).(string)
+	return identity
+}
+
+// clientIP figures out the address a request came from
+// only with trustProxyHeaders the headers set by a reverse proxy are looked at
+// clients could send them themselves otherwise and pose as somebody else
+func clientIP(r *http.Request, trustProxyHeaders bool) string {
+	if trustProxyHeaders {
+		// the left most address is the client, every proxy appends the one it saw
+		forwardedFor := strings.Split(r.Header.Get(forwardedForHeader), ",")
+		if ip := strings.TrimSpace(forwardedFor[0]); ip != "" {
+			return ip
+		}
+
+		if ip := strings.TrimSpace(r.Header.Get(realIPHeader)); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// requestLogger puts the client identity and address into the request context
+// and writes one log entry per request
+// the entries of all non-GET requests make up the audit trail
+func requestLogger(trustProxyHeaders bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			identity := clientIdentity(r)
+			ip := clientIP(r, trustProxyHeaders)
+			ctx := context.WithValue(r.Context(), identityContextKey, identity)
+			r = r.WithContext(context.WithValue(ctx, clientIPContextKey, ip))
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(recorder, r)
+
+			logrus.WithFields(logrus.Fields{
+				"method":   r.Method,
+				"path":     r.URL.Path,
+				"status":   recorder.status,
+				"duration": time.Since(start).String(),
+				"identity": identity,
+				"remote":   ip,
+				"audit":    r.Method != http.MethodGet && r.Method != http.MethodHead,
+			}).Info("request")
+		})
+	}
+}
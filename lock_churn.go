@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type churnKey struct {
+	name    string
+	stateID string
+}
+
+type churnWindow struct {
+	start time.Time
+	count int
+}
+
+// churnLimiter counts LOCKs and UNLOCKs per state in fixed windows
+// a wrapper locking and unlocking in a tight loop hits the limit
+// instead of hammering the database
+// the counts live in memory, every node limits on its own
+// a limit of zero lets everything through
+type churnLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	window    time.Duration
+	windows   map[churnKey]*churnWindow
+	lastSweep time.Time
+}
+
+func newChurnLimiter(limit int, window time.Duration) (*churnLimiter, error) {
+	cl := &churnLimiter{}
+	err := cl.configure(limit, window)
+	if err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// configure changes the limit, the counts start over
+func (cl *churnLimiter) configure(limit int, window time.Duration) error {
+	if limit > 0 && window <= 0 {
+		return fmt.Errorf("Lock churn window needs to be positive but is %s", window)
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.limit = limit
+	cl.window = window
+	cl.windows = make(map[churnKey]*churnWindow)
+	cl.lastSweep = time.Now()
+	return nil
+}
+
+// allow counts a lock operation on a state
+// if the state ran out of operations in the current window
+// it returns false and how long until the window is over
+func (cl *churnLimiter) allow(name string, stateID string) (bool, time.Duration) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.limit <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	if now.Sub(cl.lastSweep) >= cl.window {
+		// states that aren't locked anymore would pile up otherwise
+		for key, w := range cl.windows {
+			if now.Sub(w.start) >= cl.window {
+				delete(cl.windows, key)
+			}
+		}
+
+		cl.lastSweep = now
+	}
+
+	key := churnKey{name: name, stateID: stateID}
+	w, ok := cl.windows[key]
+	if !ok || now.Sub(w.start) >= cl.window {
+		w = &churnWindow{start: now}
+		cl.windows[key] = w
+	}
+
+	if w.count >= cl.limit {
+		return false, w.start.Add(cl.window).Sub(now)
+	}
+
+	w.count++
+	return true, 0
+}
@@ -18,22 +18,47 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/mhelmich/tf-locker/backend"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
+	initDB := flag.Bool("init-db", false, "create the database schema and exit")
+	flag.Parse()
+
 	logrus.Infof("Starting tf-locker...")
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 
+	config := newConfigFile(os.Getenv(configFileEnv))
+	err := config.load()
+	if err != nil {
+		logrus.Panicf("Can't read config file: %s", err.Error())
+	}
+
+	settings, err := readReloadableSettings()
+	if err != nil {
+		logrus.Panicf("Can't read settings: %s", err.Error())
+	}
+
+	logrus.SetLevel(settings.logLevel)
+	restart := restartSnapshot()
+
 	strPort := os.Getenv("PORT")
 	if strPort == "" {
 		strPort = "8080"
@@ -45,34 +70,350 @@ func main() {
 
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
-		dbURL = fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", "franz", "passwd", "franz")
+		dbURL = backend.BuildDSN(
+			os.Getenv("DB_HOST"),
+			os.Getenv("DB_PORT"),
+			getEnv("DB_USER", "franz"),
+			getEnv("DB_PASSWORD", "passwd"),
+			getEnv("DB_NAME", "franz"),
+			getEnv("DB_SSLMODE", "disable"),
+		)
+	}
+
+	statementTimeout := getEnvDuration("DB_STATEMENT_TIMEOUT", 0)
+	if statementTimeout > 0 {
+		dbURL, err = backend.WithStatementTimeout(dbURL, statementTimeout)
+		if err != nil {
+			logrus.Panicf("Can't set statement timeout: %s", err.Error())
+		}
 	}
 
-	logrus.Infof("Connecting to postgres at %s", dbURL)
-	db, err := backend.NewPostgresStore(dbURL)
+	// changing the shard count of an existing deployment needs a data migration
+	shards := getEnvInt("STATE_SHARDS", 1)
+	if *initDB || getEnv("INIT_ONLY", "false") == "true" {
+		logrus.Infof("Initializing database at %s", backend.RedactDSN(dbURL))
+		err = backend.InitSchema(dbURL, shards)
+		if err != nil {
+			logrus.Panicf("Can't initialize database: %s", err.Error())
+		}
+
+		logrus.Info("Database schema is up to date")
+		logrus.Exit(0)
+	}
+
+	backendType := getEnv("BACKEND", backend.BackendPostgres)
+	idFormat := getEnv("ID_FORMAT", idFormatUUID)
+	if idFormat != idFormatUUID && backendType == backend.BackendPostgres {
+		// the state_id columns are of type UUID
+		logrus.Panicf("ID_FORMAT=%s isn't supported by the %s backend, it stores state ids as uuids", idFormat, backendType)
+	}
+
+	pgOptions := backend.PostgresOptions{
+		IdempotencyKeyTTL:    getEnvDuration("IDEMPOTENCY_KEY_TTL", backend.DefaultIdempotencyKeyTTL),
+		Shards:               shards,
+		VersionStrategy:      getEnv("VERSION_STRATEGY", backend.VersionIncrement),
+		DeleteRecoveryWindow: getEnvDuration("DELETE_RECOVERY_WINDOW", 0),
+		MaxLockHold:          getEnvDuration("MAX_LOCK_HOLD", 0),
+		MaxLockHoldWebhook:   getEnv("MAX_LOCK_HOLD_WEBHOOK", ""),
+		ReleaseOverdueLocks:  getEnv("MAX_LOCK_HOLD_RELEASE", "false") == "true",
+		SkipMigrations:       getEnv("SKIP_MIGRATIONS", "false") == "true",
+		WriteAttempts:        getEnvInt("WRITE_ATTEMPTS", backend.DefaultWriteAttempts),
+		CompressOldVersions:  getEnv("COMPRESS_OLD_VERSIONS", "false") == "true",
+		BlobFormat:           getEnv("BLOB_FORMAT", backend.BlobFormatPlain),
+		Timeouts: backend.QueryTimeouts{
+			Default: getEnvDuration("DB_TIMEOUT", 0),
+			Get:     getEnvDuration("DB_TIMEOUT_GET", 0),
+			Write:   getEnvDuration("DB_TIMEOUT_WRITE", 0),
+			Lock:    getEnvDuration("DB_TIMEOUT_LOCK", 0),
+			List:    getEnvDuration("DB_TIMEOUT_LIST", 0),
+		},
+	}
+	etcdOptions := backend.EtcdOptions{
+		Prefix:  getEnv("ETCD_PREFIX", backend.DefaultEtcdPrefix),
+		LockTTL: getEnvDuration("ETCD_LOCK_TTL", backend.DefaultEtcdLockTTL),
+		Timeout: getEnvDuration("DB_TIMEOUT", 0),
+	}
+	if endpoints := os.Getenv("ETCD_ENDPOINTS"); endpoints != "" {
+		etcdOptions.Endpoints = strings.Split(endpoints, ",")
+	} else if backendType == backend.BackendEtcd {
+		logrus.Panicf("ETCD_ENDPOINTS is required by the %s backend", backendType)
+	}
+
+	db, err := backend.New(backendType, backend.Config{
+		DatabaseURL: dbURL,
+		Postgres:    pgOptions,
+		Etcd:        etcdOptions,
+	})
 	if err != nil {
-		logrus.Panicf("Can't parse port [%s]: %s", strPort, err.Error())
+		logrus.Panicf("Can't create %s backend: %s", backendType, err.Error())
+	}
+
+	// during a database migration all changes go to the new database as well
+	secondaryURL := os.Getenv("SECONDARY_DATABASE_URL")
+	if secondaryURL != "" {
+		// overdue locks are dealt with on the primary, the unlock gets mirrored
+		secondaryOptions := pgOptions
+		secondaryOptions.MaxLockHold = 0
+		secondary, err := backend.New(backend.BackendPostgres, backend.Config{
+			DatabaseURL: secondaryURL,
+			Postgres:    secondaryOptions,
+		})
+		if err != nil {
+			logrus.Panicf("Can't create secondary backend: %s", err.Error())
+		}
+
+		logrus.Warn("Mirroring all changes to the secondary database")
+		db = backend.NewDualWriteStore(db, secondary)
+	}
+
+	// only binaries built with the chaos tag inject failures
+	chaosRate := os.Getenv("CHAOS_FAILURE_RATE")
+	if chaosRate != "" {
+		rate, err := strconv.ParseFloat(chaosRate, 64)
+		if err != nil {
+			logrus.Panicf("Can't parse CHAOS_FAILURE_RATE [%s]: %s", chaosRate, err.Error())
+		}
+
+		chaos, err := backend.NewChaosStore(db, rate, getEnvDuration("CHAOS_DELAY", 10*time.Second))
+		if err != nil {
+			logrus.Errorf("Not injecting failures: %s", err.Error())
+		} else {
+			db = chaos
+		}
+	}
+
+	breakerFailures := getEnvInt("DB_BREAKER_FAILURES", 5)
+	if breakerFailures > 0 {
+		breakerCooldown := getEnvDuration("DB_BREAKER_COOLDOWN", 30*time.Second)
+		logrus.Infof("Circuit breaker trips after %d failures for %s", breakerFailures, breakerCooldown)
+		db = backend.NewBreakerStore(db, uint32(breakerFailures), breakerCooldown)
+	}
+
+	// sits in front of the breaker so that cached states can be read while it's open
+	cacheSize := getEnvInt("STATE_CACHE_SIZE", 0)
+	if cacheSize > 0 {
+		cacheTTL := getEnvDuration("STATE_CACHE_TTL", 5*time.Second)
+		logrus.Infof("Caching up to %d states for %s", cacheSize, cacheTTL)
+		db = backend.NewCachingStore(db, cacheSize, cacheTTL, getEnv("SERVE_STALE_ON_ERROR", "false") == "true")
+	} else if getEnv("SERVE_STALE_ON_ERROR", "false") == "true" {
+		logrus.Warn("Stale states can't be served without STATE_CACHE_SIZE")
+	}
+
+	if getEnv("STARTUP_SELFTEST", "false") == "true" {
+		if settings.readOnly || settings.maintenanceMessage != "" {
+			logrus.Warn("Skipping the self-test, it needs to write")
+		} else {
+			logrus.Info("Running self-test against the backend")
+			err = runSelfTest(db)
+			if err != nil {
+				logrus.Panicf("Self-test failed: %s", err.Error())
+			}
+		}
+	}
+
+	// terraform locks before every write, this holds other clients to the same
+	if getEnv("REQUIRE_LOCK_FOR_WRITE", "false") == "true" {
+		logrus.Info("Writes need the state to be locked")
+		db = backend.NewRequireLockStore(db)
+	}
+
+	// writes can be switched off and on again by a reload
+	modes := backend.NewWritableStore(db)
+	applyWriteMode(modes, settings)
+	db = modes
+
+	prometheus.MustRegister(newLockCollector(db))
+	lockAgeInterval := getEnvDuration("LOCK_AGE_SCAN_INTERVAL", 30*time.Second)
+	if lockAgeInterval > 0 {
+		go reportLockAges(db, lockAgeInterval)
+	}
+
+	events, err := newEventPublisher(
+		getEnv("EVENT_SINK", eventSinkNone),
+		getEnvInt("EVENT_BUFFER_SIZE", 1000),
+		getEnv("KAFKA_BROKERS", "localhost:9092"),
+		getEnv("KAFKA_TOPIC", "tf-locker-events"),
+	)
+	if err != nil {
+		logrus.Panicf("Can't create event publisher: %s", err.Error())
+	}
+
+	backup, err := newStateBackup(
+		getEnv("BACKUP_BUCKET", ""),
+		getEnv("BACKUP_ENDPOINT", ""),
+		getEnvInt("BACKUP_BUFFER_SIZE", 100),
+		getEnvInt("BACKUP_ATTEMPTS", 5),
+	)
+	if err != nil {
+		logrus.Panicf("Can't create state backup: %s", err.Error())
+	}
+
+	auth, err := newAuthenticator(authConfig{
+		mode:       getEnv("AUTH_MODE", authModeNone),
+		basicUsers: os.Getenv("BASIC_AUTH_USERS"),
+		jwksURL:    getEnv("OIDC_JWKS_URL", ""),
+		issuer:     getEnv("OIDC_ISSUER", ""),
+		audience:   getEnv("OIDC_AUDIENCE", ""),
+	})
+	if err != nil {
+		logrus.Panicf("Can't create authenticator: %s", err.Error())
+	}
+
+	accessPolicy, err := loadPolicy(getEnv("POLICY_FILE", ""), getEnv("POLICY_RULES", ""))
+	if err != nil {
+		logrus.Panicf("Can't load policy: %s", err.Error())
+	}
+
+	cfg := httpServerConfig{
+		port:                    httpPort,
+		lockMethod:              getEnv("LOCK_METHOD", "LOCK"),
+		unlockMethod:            getEnv("UNLOCK_METHOD", "UNLOCK"),
+		healthPath:              getEnv("HEALTH_PATH", "/healthz"),
+		metricsPath:             getEnv("METRICS_PATH", "/metrics"),
+		compression:             getEnv("RESPONSE_COMPRESSION", compressionNone),
+		compressionMinBytes:     getEnvInt("COMPRESSION_MIN_BYTES", 1024),
+		writeSuccessStatus:      getEnvInt("WRITE_SUCCESS_STATUS", http.StatusOK),
+		lockWaitTimeout:         settings.lockWaitTimeout,
+		maxLockWaitTimeout:      settings.maxLockWaitTimeout,
+		compactRetention:        getEnvInt("COMPACT_RETENTION", 10),
+		versionsLimit:           getEnvInt("VERSIONS_LIMIT", 100),
+		maxVersionsLimit:        getEnvInt("VERSIONS_LIMIT_MAX", 1000),
+		defaultStateName:        getEnv("DEFAULT_STATE_NAME", ""),
+		events:                  events,
+		backup:                  backup,
+		minTerraformVersion:     getEnv("MIN_TERRAFORM_VERSION", ""),
+		trustProxyHeaders:       getEnv("TRUST_PROXY_HEADERS", "false") == "true",
+		exposeLockInfo:          getEnv("EXPOSE_LOCK_INFO", "false") == "true",
+		signedURLSecret:         os.Getenv("SIGNED_URL_SECRET"),
+		signedURLTTL:            getEnvDuration("SIGNED_URL_TTL", 5*time.Minute),
+		readTimeout:             getEnvDuration("HTTP_READ_TIMEOUT", 60*time.Second),
+		writeTimeout:            getEnvDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		idleTimeout:             getEnvDuration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		readHeaderTimeout:       getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		maxHeaderBytes:          getEnvInt("HTTP_MAX_HEADER_BYTES", 64*1024),
+		h2c:                     getEnv("HTTP2_CLEARTEXT", "false") == "true",
+		idFormat:                idFormat,
+		stateNamePattern:        os.Getenv("STATE_NAME_PATTERN"),
+		proxyProtocol:           getEnv("PROXY_PROTOCOL", "false") == "true",
+		lockChurnLimit:          settings.lockChurnLimit,
+		lockChurnWindow:         settings.lockChurnWindow,
+		unlockMismatchStatus:    getEnvInt("UNLOCK_MISMATCH_STATUS", http.StatusForbidden),
+		captureFailedRequests:   getEnv("CAPTURE_FAILED_REQUESTS", "false") == "true",
+		failedRequestsDir:       getEnv("FAILED_REQUESTS_DIR", filepath.Join(os.TempDir(), "tf-locker-failed-requests")),
+		failedRequestsRetention: getEnvInt("FAILED_REQUESTS_RETENTION", 100),
+		auth:                    auth,
+		policy:                  accessPolicy,
 	}
 
 	logrus.Infof("Start REST service at %d", httpPort)
-	httpServer, err := startNewHTTPServer(httpPort, db)
+	httpServer, err := startNewHTTPServer(cfg, db)
 	if err != nil {
 		logrus.Panicf("Can't start http server: %s", err.Error())
 	}
 
+	// SIGUSR1 drains the node ahead of the SIGTERM of a rolling restart
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	go func() {
+		for range drain {
+			httpServer.drain()
+		}
+	}()
+
+	// SIGHUP reloads the settings that can change without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	rl := &reloader{
+		config:  config,
+		server:  httpServer,
+		modes:   modes,
+		restart: restart,
+	}
+	go func() {
+		for range hup {
+			rl.reload()
+		}
+	}()
+
 	sig := <-c
 	cleanup(sig, httpServer, db)
 }
 
+func getEnv(key string, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := parseEnvInt(key, defaultValue)
+	if err != nil {
+		logrus.Panic(err.Error())
+	}
+
+	return value
+}
+
+func parseEnvInt(key string, defaultValue int) (int, error) {
+	strValue := os.Getenv(key)
+	if strValue == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(strValue)
+	if err != nil {
+		return 0, fmt.Errorf("Can't parse %s [%s]: %s", key, strValue, err.Error())
+	}
+
+	return value, nil
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := parseEnvDuration(key, defaultValue)
+	if err != nil {
+		logrus.Panic(err.Error())
+	}
+
+	return value
+}
+
+func parseEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	strValue := os.Getenv(key)
+	if strValue == "" {
+		return defaultValue, nil
+	}
+
+	value, err := time.ParseDuration(strValue)
+	if err != nil {
+		return 0, fmt.Errorf("Can't parse %s [%s]: %s", key, strValue, err.Error())
+	}
+
+	return value, nil
+}
+
 func cleanup(sig os.Signal, httpServer *httpServer, store backend.Store) {
 	logrus.Info("This node is going down gracefully\n")
 	logrus.Infof("Received signal: %s\n", sig)
 
+	exitCode := 0
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	httpServer.Shutdown(ctx)
+	err := httpServer.Shutdown(ctx)
+	if err != nil {
+		// whatever is still running gets cut off when the process exits
+		logrus.Errorf("Shutdown didn't complete, abandoning %d active connections: %s", httpServer.conns.active(), err.Error())
+		exitCode = 1
+	} else {
+		logrus.Info("All requests completed")
+	}
+
+	httpServer.events.close()
+	httpServer.backup.close()
 
 	store.Close()
 
-	logrus.Exit(0)
+	logrus.Exit(exitCode)
 }
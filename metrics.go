@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhelmich/tf-locker/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	locksHeldDesc = prometheus.NewDesc(
+		"tf_locker_locks_held",
+		"Number of currently held locks by terraform operation and version",
+		[]string{"operation", "version"},
+		nil,
+	)
+
+	oldestLockAgeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tf_locker_oldest_lock_age_seconds",
+		Help: "Age of the oldest currently held lock, zero if no lock is held",
+	})
+
+	lockAgeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tf_locker_lock_age_seconds",
+		Help: "Age of every currently held lock",
+	}, []string{"name", "state_id"})
+
+	lockConflictCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tf_locker_lock_conflict_total",
+		Help: "Number of requests turned away because somebody else held the lock",
+	}, []string{"name"})
+
+	versionConflictCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tf_locker_version_conflict_total",
+		Help: "Number of writes that lost the race for a version against concurrent writers",
+	}, []string{"name"})
+
+	staleReadsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tf_locker_stale_reads_total",
+		Help: "Number of reads answered from the cache because the backend failed",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(oldestLockAgeGauge)
+	prometheus.MustRegister(lockAgeGauge)
+	prometheus.MustRegister(lockConflictCounter)
+	prometheus.MustRegister(versionConflictCounter)
+	prometheus.MustRegister(staleReadsCounter)
+}
+
+// countConflict counts the store errors that come from contention on a state
+// teams stepping on each others applies show up as high rates
+func countConflict(name string, err error) {
+	switch {
+	case errors.Is(err, backend.ErrAlreadyLocked):
+		lockConflictCounter.WithLabelValues(name).Inc()
+	case errors.Is(err, backend.ErrVersionConflict):
+		versionConflictCounter.WithLabelValues(name).Inc()
+	}
+}
+
+// reportLockAges updates the lock age gauges every interval
+// alerts on stuck locks go off the oldest lock age
+// while the per lock ages point at the states that are stuck
+func reportLockAges(store backend.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		locks, err := store.ListLocks()
+		if err != nil {
+			logrus.Errorf("Can't list locks for lock ages: %s", err.Error())
+			continue
+		}
+
+		var oldest time.Duration
+		lockAgeGauge.Reset()
+		for _, lock := range locks {
+			// old locks taken with only an id don't say when they were taken
+			if lock.HeldSince().IsZero() {
+				continue
+			}
+
+			age := time.Since(lock.HeldSince())
+			lockAgeGauge.WithLabelValues(lock.Name, lock.StateID).Set(age.Seconds())
+			if age > oldest {
+				oldest = age
+			}
+		}
+
+		oldestLockAgeGauge.Set(oldest.Seconds())
+	}
+}
+
+// lockCollector reports the locks currently held every time prometheus scrapes
+type lockCollector struct {
+	store backend.Store
+}
+
+func newLockCollector(store backend.Store) *lockCollector {
+	return &lockCollector{
+		store: store,
+	}
+}
+
+func (lc *lockCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- locksHeldDesc
+}
+
+func (lc *lockCollector) Collect(ch chan<- prometheus.Metric) {
+	locks, err := lc.store.ListLocks()
+	if err != nil {
+		logrus.Errorf("Can't list locks for metrics: %s", err.Error())
+		return
+	}
+
+	type key struct {
+		operation string
+		version   string
+	}
+
+	counts := make(map[key]int)
+	for _, lock := range locks {
+		counts[key{lock.LockInfo.Operation, lock.LockInfo.Version}]++
+	}
+
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(locksHeldDesc, prometheus.GaugeValue, float64(count), k.operation, k.version)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// anyPrincipal in a rule stands for every authenticated client
+const anyPrincipal = "*"
+
+// policyRule lets a principal use some methods on the states whose names match one of the patterns
+// patterns are regexes that need to match the name in full, the workspaces of a name go with it
+// no methods means all of them
+type policyRule struct {
+	Principal string   `json:"principal"`
+	Names     []string `json:"names"`
+	Methods   []string `json:"methods"`
+	// the rule also covers requests that don't address a state
+	// like the listings and everything under /admin
+	Admin bool `json:"admin"`
+
+	patterns []*regexp.Regexp
+}
+
+func (pr *policyRule) matches(principal string, name string, method string) bool {
+	if pr.Principal != anyPrincipal && pr.Principal != principal {
+		return false
+	}
+
+	if len(pr.Methods) > 0 {
+		permitted := false
+		for _, m := range pr.Methods {
+			permitted = permitted || strings.EqualFold(m, method)
+		}
+
+		if !permitted {
+			return false
+		}
+	}
+
+	if name == "" {
+		return pr.Admin
+	}
+
+	for _, pattern := range pr.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policy decides which principal may do what with which states
+// everything no rule allows is forbidden
+type policy struct {
+	rules []*policyRule
+}
+
+// loadPolicy reads the rules as a json list out of file or, without file, out of rules
+// it returns nil if neither is set, then everybody may do everything
+func loadPolicy(file string, rules string) (*policy, error) {
+	bites := []byte(rules)
+	if file != "" && rules != "" {
+		return nil, fmt.Errorf("Policies come either from a file or from the environment, not both")
+	} else if file != "" {
+		var err error
+		bites, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read policy file [%s]: %s", file, err.Error())
+		}
+	} else if rules == "" {
+		return nil, nil
+	}
+
+	p := &policy{}
+	err := json.Unmarshal(bites, &p.rules)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse policy rules: %s", err.Error())
+	}
+
+	for _, rule := range p.rules {
+		if rule.Principal == "" {
+			return nil, fmt.Errorf("Policy rule without principal")
+		}
+
+		for _, name := range rule.Names {
+			pattern, err := regexp.Compile("^(?:" + name + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("Can't compile state name pattern [%s] of [%s]: %s", name, rule.Principal, err.Error())
+			}
+
+			rule.patterns = append(rule.patterns, pattern)
+		}
+	}
+
+	return p, nil
+}
+
+// allows tells whether principal may use method on the states called name
+// an empty name is a request that doesn't address a state
+func (p *policy) allows(principal string, name string, method string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.rules {
+		if rule.matches(principal, name, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorized tells whether the policy lets the client of a request use its method on name
+// a signed url that verifies for the request carries its own permission
+func (s *httpServer) authorized(r *http.Request, name string) bool {
+	if s.signedURLGrants(r) {
+		return true
+	}
+
+	return s.policy.allows(authenticatedPrincipal(r), name, r.Method)
+}
+
+// authenticatedPrincipal is who the authenticator accepted
+// self-reported identities never count for the policy
+func authenticatedPrincipal(r *http.Request) string {
+	principal, _ := r.Context().Value(authenticatedContextKey).(string)
+	return principal
+}
+
+// authorize answers requests the policy doesn't allow with a 403
+// it runs after authentication, the policy is about who the client proved to be
+func (s *httpServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the workspace isn't part of the name the patterns see
+		vars := pathVars(r)
+		name, ok := vars["name"]
+		if !ok && vars["state_id"] != "" {
+			name = s.defaultStateName
+		}
+
+		if !s.authorized(r, name) {
+			logrus.Warnf("Policy doesn't allow [%s] to %s [%s]", authenticatedPrincipal(r), r.Method, name)
+			writeError(w, http.StatusForbidden, "Not allowed by policy")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mhelmich/tf-locker/backend"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the state the self-test works on, no client should ever use it
+	selfTestStateID = "00000000-0000-0000-0000-000000000000"
+	selfTestName    = "tf-locker-selftest"
+	selfTestOwner   = "tf-locker"
+)
+
+// runSelfTest does a lock, write, read and unlock round trip against the store
+// so that missing permissions or a broken schema show up before traffic arrives
+// the state is purged before and after
+func runSelfTest(store backend.Store) error {
+	// a self-test that died half-way leaves its state behind
+	err := store.PurgeState(selfTestStateID, selfTestName, true)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		return fmt.Errorf("Can't clean up before the self-test: %w", err)
+	}
+
+	lockInfo, err := json.Marshal(&backend.LockInfo{
+		ID:        uuid.New().String(),
+		Operation: "selftest",
+		Who:       selfTestOwner,
+		Created:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	lockID, err := store.LockState(selfTestStateID, selfTestName, string(lockInfo), selfTestOwner)
+	if err != nil {
+		return fmt.Errorf("Self-test LOCK failed: %w", err)
+	}
+	logrus.Infof("Self-test LOCK succeeded: %s", lockID)
+
+	_, err = store.GetState(selfTestStateID, selfTestName)
+	if err != nil {
+		return fmt.Errorf("Self-test GET of the locked state failed: %w", err)
+	}
+	logrus.Info("Self-test GET succeeded")
+
+	data := []byte(fmt.Sprintf(`{"version":4,"serial":1,"lineage":"%s"}`, uuid.New().String()))
+	result, err := store.UpsertState(selfTestStateID, selfTestName, lockID, data, "")
+	if err != nil {
+		return fmt.Errorf("Self-test UPSERT failed: %w", err)
+	}
+	logrus.Infof("Self-test UPSERT succeeded: version %d", result.Version)
+
+	read, err := store.GetState(selfTestStateID, selfTestName)
+	if err != nil {
+		return fmt.Errorf("Self-test GET of the written state failed: %w", err)
+	} else if !bytes.Equal(read, data) {
+		return fmt.Errorf("Self-test GET returned %d bytes that differ from the %d bytes written", len(read), len(data))
+	}
+	logrus.Info("Self-test GET of the written state succeeded")
+
+	err = store.UnlockState(selfTestStateID, selfTestName, lockID)
+	if err != nil {
+		return fmt.Errorf("Self-test UNLOCK failed: %w", err)
+	}
+	logrus.Info("Self-test UNLOCK succeeded")
+
+	err = store.PurgeState(selfTestStateID, selfTestName, false)
+	if err != nil {
+		return fmt.Errorf("Can't clean up after the self-test: %w", err)
+	}
+
+	logrus.Info("Self-test passed")
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// the query parameter signed urls carry their token in
+const signedURLTokenParam = "token"
+
+var errInvalidToken = errors.New("Invalid token")
+
+// signedToken is what a signed url grants
+// the token is only good for one method on one state until it expires
+type signedToken struct {
+	Name    string `json:"name"`
+	StateID string `json:"state_id"`
+	Method  string `json:"method"`
+	Expires int64  `json:"exp"`
+	// who asked for the token
+	Issuer string `json:"iss,omitempty"`
+}
+
+// urlSigner hands out and checks tokens for signed urls
+// a token is the base64 encoded json of a signedToken and its hmac
+// both separated by a dot
+type urlSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func newURLSigner(secret string, ttl time.Duration) *urlSigner {
+	return &urlSigner{
+		secret: []byte(secret),
+		ttl:    ttl,
+	}
+}
+
+func (us *urlSigner) mac(payload string) string {
+	h := hmac.New(sha256.New, us.secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (us *urlSigner) sign(token *signedToken) (string, error) {
+	j, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(j)
+	return payload + "." + us.mac(payload), nil
+}
+
+// verify checks that a token is intact, hasn't expired and grants method on the state
+func (us *urlSigner) verify(token string, name string, stateID string, method string) (*signedToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(us.mac(parts[0])), []byte(parts[1])) {
+		return nil, errInvalidToken
+	}
+
+	j, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	st := &signedToken{}
+	err = json.Unmarshal(j, st)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	if time.Now().Unix() > st.Expires {
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	} else if st.Name != name || !strings.EqualFold(st.StateID, stateID) || st.Method != method {
+		return nil, fmt.Errorf("%w: not valid for this request", errInvalidToken)
+	}
+
+	return st, nil
+}
+
+// signedURLGrants tells whether the request carries a token that's good for it
+// tokens are only handed out for reading a state, every other route needs credentials
+func (s *httpServer) signedURLGrants(r *http.Request) bool {
+	token := r.URL.Query().Get(signedURLTokenParam)
+	if s.signer == nil || token == "" || r.Method != http.MethodGet {
+		return false
+	}
+
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+
+	switch route.GetName() {
+	case "getState", "getDefaultState", "getWorkspaceState":
+	default:
+		return false
+	}
+
+	vars := pathVars(r)
+	_, err := s.signer.verify(token, s.stateName(vars), vars["state_id"], r.Method)
+	return err == nil
+}
+
+type signedURLResponse struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createSignedURL hands out a url that reads the state without credentials for a while
+// only clients that authenticated with a certificate or basic auth get one,
+// a self-reported user name isn't good enough to pass on access
+func (s *httpServer) createSignedURL(w http.ResponseWriter, r *http.Request) {
+	vars := pathVars(r)
+	name := s.stateName(vars)
+	stateID := vars["state_id"]
+	defer r.Body.Close()
+
+	err := s.validateIDs(s.configName(vars), vars["workspace"], stateID)
+	if err != nil {
+		logrus.Errorf("Invalid state_id: %s", err.Error())
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	issuer := authenticatedIdentity(r)
+	if issuer == "" {
+		logrus.Errorf("Unauthenticated request for a signed url of [%s] [%s]", name, stateID)
+		writeError(w, http.StatusUnauthorized, "Signed urls are only handed out to authenticated clients")
+		return
+	}
+
+	expires := time.Now().Add(s.signer.ttl).Truncate(time.Second)
+	token, err := s.signer.sign(&signedToken{
+		Name:    name,
+		StateID: stateID,
+		Method:  http.MethodGet,
+		Expires: expires.Unix(),
+		Issuer:  issuer,
+	})
+	if err != nil {
+		logrus.Errorf("Can't sign url for [%s] [%s]: %s", name, stateID, err.Error())
+		writeError(w, http.StatusInternalServerError, "Can't sign url")
+		return
+	}
+
+	logrus.Infof("SIGNED-URL: %s %s for %s until %s", name, stateID, issuer, expires)
+	writeJSON(w, http.StatusOK, &signedURLResponse{
+		URL:       strings.TrimSuffix(r.URL.EscapedPath(), "/signed-url") + "?" + signedURLTokenParam + "=" + token,
+		Token:     token,
+		ExpiresAt: expires,
+	})
+}
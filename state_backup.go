@@ -0,0 +1,241 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mhelmich/tf-locker/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// gcs speaks the s3 protocol with HMAC keys on this endpoint
+const gcsEndpoint = "https://storage.googleapis.com"
+
+var (
+	backupsDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tf_locker_backups_dropped_total",
+		Help: "Number of state versions that weren't backed up because the buffer was full",
+	})
+	backupFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tf_locker_backup_failures_total",
+		Help: "Number of state versions that couldn't be backed up after all attempts",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(backupsDroppedCounter)
+	prometheus.MustRegister(backupFailuresCounter)
+}
+
+// backupUpload is a written version of a state waiting to be backed up
+type backupUpload struct {
+	name    string
+	stateID string
+	version int
+	data    []byte
+}
+
+// stateBackup copies every written version of a state into a bucket in the background
+// objects are keyed name/state_id/version below the path of the bucket url
+// uploads are retried but never hold up terraform, a full buffer drops them
+type stateBackup struct {
+	client   *s3.S3
+	bucket   string
+	prefix   string
+	attempts int
+	uploads  chan *backupUpload
+	done     chan struct{}
+}
+
+// newStateBackup returns nil if no bucket is configured
+// a nil backup drops all uploads
+// bucketURL is s3://bucket/prefix or gs://bucket/prefix
+// credentials come from the usual AWS_* environment, HMAC keys for gcs
+func newStateBackup(bucketURL string, endpoint string, bufferSize int, attempts int) (*stateBackup, error) {
+	if bucketURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("Can't parse backup bucket [%s]: %s", bucketURL, err.Error())
+	} else if u.Host == "" {
+		return nil, fmt.Errorf("Backup bucket [%s] doesn't name a bucket", bucketURL)
+	}
+
+	config := aws.NewConfig()
+	switch u.Scheme {
+	case "s3":
+	case "gs":
+		if endpoint == "" {
+			endpoint = gcsEndpoint
+		}
+
+		config = config.WithRegion("auto")
+	default:
+		return nil, fmt.Errorf("Backup bucket [%s] needs to be an s3:// or gs:// url", bucketURL)
+	}
+
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	sb := &stateBackup{
+		client:   s3.New(sess),
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		attempts: attempts,
+		uploads:  make(chan *backupUpload, bufferSize),
+		done:     make(chan struct{}),
+	}
+
+	go sb.run()
+	return sb, nil
+}
+
+// stateDir is where the versions of a state are kept
+// names can contain slashes, they're escaped so that they stay one segment
+func (sb *stateBackup) stateDir(name string, stateID string) string {
+	return path.Join(sb.prefix, url.PathEscape(name), stateID) + "/"
+}
+
+func (sb *stateBackup) run() {
+	defer close(sb.done)
+	for upload := range sb.uploads {
+		err := sb.upload(upload)
+		if err != nil {
+			backupFailuresCounter.Inc()
+			logrus.Errorf("Can't back up version %d of [%s] [%s]: %s", upload.version, upload.name, upload.stateID, err.Error())
+		}
+	}
+}
+
+// upload puts a version into the bucket
+// the wait between attempts doubles, starting at a second
+func (sb *stateBackup) upload(upload *backupUpload) error {
+	key := sb.stateDir(upload.name, upload.stateID) + strconv.Itoa(upload.version)
+	delay := time.Second
+	var err error
+	for attempt := 1; attempt <= sb.attempts; attempt++ {
+		_, err = sb.client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(sb.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(upload.data),
+			ContentType: aws.String("application/json"),
+		})
+		if err == nil {
+			return nil
+		} else if attempt < sb.attempts {
+			logrus.Warnf("Backing up version %d of [%s] [%s] failed (attempt %d of %d): %s", upload.version, upload.name, upload.stateID, attempt, sb.attempts, err.Error())
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return err
+}
+
+// backup queues a written version for upload
+// the data mustn't be changed afterwards
+func (sb *stateBackup) backup(name string, stateID string, version int, data []byte) {
+	if sb == nil {
+		return
+	}
+
+	select {
+	case sb.uploads <- &backupUpload{name: name, stateID: stateID, version: version, data: data}:
+	default:
+		backupsDroppedCounter.Inc()
+		logrus.Warnf("Backup buffer is full, dropping version %d of [%s] [%s]", version, name, stateID)
+	}
+}
+
+// latest reads the newest version of a state out of the bucket
+// it's backend.ErrNotFound if the state was never backed up
+func (sb *stateBackup) latest(ctx context.Context, name string, stateID string) ([]byte, int, error) {
+	dir := sb.stateDir(name, stateID)
+	version := 0
+	err := sb.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(sb.bucket),
+		Prefix: aws.String(dir),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			v, err := strconv.Atoi(strings.TrimPrefix(aws.StringValue(object.Key), dir))
+			if err == nil && v > version {
+				version = v
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	} else if version == 0 {
+		return nil, 0, fmt.Errorf("No backup of [%s] [%s]: %w", name, stateID, backend.ErrNotFound)
+	}
+
+	out, err := sb.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(sb.bucket),
+		Key:    aws.String(dir + strconv.Itoa(version)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return data, version, nil
+}
+
+// close uploads the buffered versions
+func (sb *stateBackup) close() {
+	if sb == nil {
+		return
+	}
+
+	close(sb.uploads)
+	<-sb.done
+}
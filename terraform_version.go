@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 Marco Helmich
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// terraformVersion is a parsed major.minor.patch version
+// pre-release suffixes like -beta1 are ignored
+type terraformVersion [3]int
+
+func parseTerraformVersion(s string) (terraformVersion, error) {
+	v := terraformVersion{}
+	s = strings.TrimPrefix(s, "v")
+	if idx := strings.IndexAny(s, "-+"); idx >= 0 {
+		s = s[:idx]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > len(v) {
+		return v, fmt.Errorf("Can't parse terraform version [%s]", s)
+	}
+
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("Can't parse terraform version [%s]", s)
+		}
+
+		v[idx] = n
+	}
+
+	return v, nil
+}
+
+func (v terraformVersion) less(other terraformVersion) bool {
+	for idx := range v {
+		if v[idx] != other[idx] {
+			return v[idx] < other[idx]
+		}
+	}
+
+	return false
+}
+
+func (v terraformVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+// terraformVersionOf reads the terraform_version field of a state
+// it walks the top level of the document token by token
+// and stops as soon as it found the field
+// nested values like resources are skipped without being decoded
+func terraformVersionOf(state []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(state))
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	} else if tok != json.Delim('{') {
+		return "", fmt.Errorf("State isn't a json object")
+	}
+
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return "", err
+		}
+
+		if tok == "terraform_version" {
+			var version string
+			err = dec.Decode(&version)
+			return version, err
+		}
+
+		err = skipValue(dec)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("State doesn't have a terraform_version")
+}
+
+// skipValue consumes the next value including everything nested in it
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// checkTerraformVersion rejects states written by a terraform older than min
+func checkTerraformVersion(state []byte, min terraformVersion) error {
+	s, err := terraformVersionOf(state)
+	if err != nil {
+		return err
+	}
+
+	v, err := parseTerraformVersion(s)
+	if err != nil {
+		return err
+	}
+
+	if v.less(min) {
+		return fmt.Errorf("State was written by terraform %s but at least %s is required", v.String(), min.String())
+	}
+
+	return nil
+}